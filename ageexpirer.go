@@ -11,6 +11,8 @@ type ageExpirer struct {
 
 // AgeExpirer is an Expirer that works by time since create/last modify/last access with an optional array of ExpireFunc's
 // which if provided will be checked first
+// The ExpireFunc's are checked in order, the first to return ExpireTrue or ExpireFalse decides without checking the
+// times. If all return ExpireNull, the item is expired if any of the times has been exceeded.
 func AgeExpirer(cTime, mTime, aTime time.Duration, cb ...ExpireFunc) Expirer {
 	return &ageExpirer{
 		cTime: cTime,
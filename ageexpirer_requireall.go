@@ -11,6 +11,8 @@ type ageExpirerRequireAll struct {
 
 // AgeExpirerRequireAll is an Expirer that checks the provided times since create/last modify/last access and
 // the provided ExpireFunc's and marks the item as expired only if all provided values are true
+// As with AgeExpirer, the ExpireFunc's are checked first and in order, the first to return ExpireFalse keeps the item
+// without checking the times. ExpireTrue and ExpireNull leave the decision to the remaining checks.
 func AgeExpirerRequireAll(cTime, mTime, aTime time.Duration, cb ...ExpireFunc) Expirer {
 	return &ageExpirerRequireAll{
 		cTime: cTime,
@@ -22,6 +24,12 @@ func AgeExpirerRequireAll(cTime, mTime, aTime time.Duration, cb ...ExpireFunc) E
 
 // IsExpired implements the necessary function for an Expirer
 func (ae *ageExpirerRequireAll) IsExpired(a interface{}, now time.Time, stats Stats) bool {
+	for _, cb := range ae.cb {
+		if cb(a, now, stats) == ExpireFalse {
+			return false
+		}
+	}
+
 	cTime := stats.Created
 	mTime := stats.Modified
 	if mTime.IsZero() {
@@ -32,23 +40,14 @@ func (ae *ageExpirerRequireAll) IsExpired(a interface{}, now time.Time, stats St
 		aTime = mTime
 	}
 
-	expired := true
 	if ae.cTime != 0 && now.Sub(cTime) < ae.cTime {
-		expired = false
+		return false
 	}
 	if ae.aTime != 0 && now.Sub(aTime) < ae.aTime {
-		expired = false
+		return false
 	}
 	if ae.mTime != 0 && now.Sub(mTime) < ae.mTime {
-		expired = false
-	}
-
-	for _, cb := range ae.cb {
-		if v := cb(a, now, stats); v == ExpireFalse {
-			expired = false
-		} else if v == ExpireTrue {
-			expired = true
-		}
+		return false
 	}
-	return expired
+	return true
 }
@@ -0,0 +1,194 @@
+package memdb
+
+import (
+	"github.com/google/btree"
+
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// deadline is the earliest time at which a wrap could possibly expire
+type deadline struct {
+	at time.Time
+	w  *wrap
+}
+
+// deadlineHeap is a min-heap of deadlines, ordered by earliest first
+// Each wrap's position in the heap is kept in its due field (offset by one, so that zero means it is not queued),
+// allowing a wrap's entry to be updated or removed in place.
+type deadlineHeap []deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].w.due = i + 1
+	h[j].w.due = j + 1
+}
+func (h *deadlineHeap) Push(x interface{}) {
+	d := x.(deadline)
+	d.w.due = len(*h) + 1
+	*h = append(*h, d)
+}
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	d := old[n-1]
+	d.w.due = 0
+	old[n-1] = deadline{}
+	*h = old[:n-1]
+	return d
+}
+
+// deadlines tracks when items in a store using an age based expirer may next expire, allowing Expire to only examine
+// items that could actually be expired instead of scanning the whole store
+// Deadlines are computed when an item is written, as reads and writes only ever push an item's real deadline later,
+// the recorded deadline is a lower bound. When it passes the item is checked and, if it has not expired, requeued with
+// a fresh deadline. Each wrap has at most one entry, which is dropped when the item is replaced or removed.
+type deadlines struct {
+	sync.Mutex
+
+	expirer *ageExpirer
+	heap    deadlineHeap
+}
+
+// deadlineExpirer returns the age based expirer if the store's expirer has predictable deadlines, or nil if not
+func deadlineExpirer(expirer Expirer) *ageExpirer {
+	if ae, ok := expirer.(*ageExpirer); ok && len(ae.cb) == 0 {
+		return ae
+	}
+	return nil
+}
+
+// deadline returns the earliest time the item with the given stats could expire, and false if it never will
+func (ae *ageExpirer) deadline(stats Stats) (time.Time, bool) {
+	cTime := stats.Created
+	mTime := stats.Modified
+	if mTime.IsZero() {
+		mTime = cTime
+	}
+	aTime := stats.Accessed
+	if aTime.IsZero() {
+		aTime = mTime
+	}
+
+	var at time.Time
+	earliest := func(base time.Time, age time.Duration) {
+		if age == 0 {
+			return
+		}
+		if t := base.Add(age); at.IsZero() || t.Before(at) {
+			at = t
+		}
+	}
+	earliest(cTime, ae.cTime)
+	earliest(aTime, ae.aTime)
+	earliest(mTime, ae.mTime)
+
+	return at, !at.IsZero()
+}
+
+// push records the deadline of each of the given wraps, replacing any deadline already recorded for them
+func (d *deadlines) push(ws ...*wrap) {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, w := range ws {
+		at, ok := d.expirer.deadline(w.stats.copy())
+		w.RLock()
+		if ok && at.Before(w.held) {
+			at = w.held
+		}
+		w.RUnlock()
+		switch {
+		case w.due > 0 && ok:
+			d.heap[w.due-1].at = at
+			heap.Fix(&d.heap, w.due-1)
+		case w.due > 0:
+			heap.Remove(&d.heap, w.due-1)
+		case ok:
+			heap.Push(&d.heap, deadline{at: at, w: w})
+		}
+	}
+}
+
+// drop removes the recorded deadlines of the given wraps, if any
+func (d *deadlines) drop(ws ...*wrap) {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, w := range ws {
+		if w.due > 0 {
+			heap.Remove(&d.heap, w.due-1)
+		}
+	}
+}
+
+// clear removes all of the recorded deadlines
+func (d *deadlines) clear() {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, entry := range d.heap {
+		entry.w.due = 0
+	}
+	d.heap = nil
+}
+
+// due removes and returns the wraps whose deadlines have passed, up to limit (if limit is non-zero)
+func (d *deadlines) due(now time.Time, limit int) []*wrap {
+	d.Lock()
+	defer d.Unlock()
+
+	var ws []*wrap
+	for len(d.heap) > 0 && !d.heap[0].at.After(now) {
+		if limit > 0 && len(ws) >= limit {
+			break
+		}
+		ws = append(ws, heap.Pop(&d.heap).(deadline).w)
+	}
+	return ws
+}
+
+// trackDeadlines starts tracking expiry deadlines if the store's expirer has predictable deadlines, otherwise stops
+// Must be called with the store's lock held.
+func (s *Store) trackDeadlines() {
+	if s.deadlines != nil {
+		s.deadlines.clear()
+	}
+
+	ae := deadlineExpirer(s.expirer)
+	if ae == nil {
+		s.deadlines = nil
+		return
+	}
+
+	s.deadlines = &deadlines{expirer: ae}
+	if s.backing == nil {
+		return
+	}
+
+	var ws []*wrap
+	s.backing.Ascend(func(item btree.Item) bool {
+		if w, ok := item.(*wrap); ok {
+			ws = append(ws, w)
+		}
+		return true
+	})
+	s.deadlines.push(ws...)
+}
+
+// requeue records fresh deadlines for wraps that were found due but were not removed
+func (s *Store) requeue(ws []*wrap) {
+	if s.deadlines != nil && len(ws) > 0 {
+		s.deadlines.push(ws...)
+	}
+}
+
+// dropDeadlines stops tracking the deadlines of wraps which have been replaced or removed
+func (s *Store) dropDeadlines(ws ...*wrap) {
+	if s.deadlines != nil {
+		s.deadlines.drop(ws...)
+	}
+}
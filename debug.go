@@ -0,0 +1,121 @@
+package memdb
+
+import (
+	"github.com/google/btree"
+
+	"fmt"
+	"os"
+)
+
+// debug enables internal consistency assertions, set the MEMDB_DEBUG environment variable to enable
+var debug = os.Getenv("MEMDB_DEBUG") != ""
+
+// orphan is an index or UID entry which refers to an item no longer in the store
+type orphan struct {
+	index *Index
+	key   string
+	uid   UID
+	w     *wrap
+}
+
+func (o orphan) Error() string {
+	if o.index != nil {
+		return fmt.Sprintf("memdb: index %q key %q holds item %#v (uid %s) which is not in the store", o.index.id, o.key, o.w.item, o.w.uid)
+	}
+	return fmt.Sprintf("memdb: uid %s refers to item %#v which is not in the store", o.uid, o.w.item)
+}
+
+// Verify cross-checks the store's indexes and UIDs against the items held in the store, returning an error for each
+// entry which refers to an item no longer in the store
+func (s *Store) Verify() []error {
+	s.RLock()
+	defer s.RUnlock()
+
+	var errs []error
+	for _, o := range s.orphans() {
+		errs = append(errs, o)
+	}
+	return errs
+}
+
+// Repair removes any index and UID entries which refer to items no longer in the store, returning the number removed
+// It is safe to call periodically, but as it examines the whole store, it holds the store's lock for some time.
+func (s *Store) Repair() int {
+	s.Lock()
+	defer s.Unlock()
+
+	orphans := s.orphans()
+	for _, o := range orphans {
+		if o.index != nil {
+			s.rmFromIndex(o.index.id, o.key, o.w)
+		} else {
+			delete(s.uids, o.uid)
+		}
+	}
+	return len(orphans)
+}
+
+func (s *Store) orphans() []orphan {
+	present := map[*wrap]bool{}
+	s.backing.Ascend(func(item btree.Item) bool {
+		if w, ok := item.(*wrap); ok {
+			present[w] = true
+		}
+		return true
+	})
+
+	var orphans []orphan
+	for id, index := range s.indexes {
+		for key, wraps := range s.index[id] {
+			for _, w := range wraps {
+				if !present[w] {
+					orphans = append(orphans, orphan{index: index, key: key, w: w})
+				}
+			}
+		}
+	}
+	for uid, w := range s.uids {
+		if !present[w] {
+			orphans = append(orphans, orphan{uid: uid, w: w})
+		}
+	}
+	return orphans
+}
+
+// assertIndexed panics if the wrap's presence in any of the indexes does not match its computed values
+// It is a no-op unless debugging is enabled.
+func (s *Store) assertIndexed(w *wrap, present bool) {
+	if !debug {
+		return
+	}
+
+	expect := 0
+	if present {
+		expect = 1
+	}
+
+	for _, index := range s.indexes {
+		for _, key := range w.values[index.n] {
+			found := 0
+			for _, indexWrap := range s.index[index.id][key] {
+				if indexWrap == w {
+					found++
+				}
+			}
+
+			if found != expect {
+				panic(fmt.Sprintf(
+					"memdb: index %q inconsistent for item %#v (uid %s): found %d times under key %q, expected %d",
+					index.id, w.item, w.uid, found, key, expect,
+				))
+			}
+		}
+	}
+
+	if _, ok := s.uids[w.uid]; ok != present && s.hasUIDs() {
+		panic(fmt.Sprintf(
+			"memdb: uid map inconsistent for item %#v (uid %s): present %t, expected %t",
+			w.item, w.uid, ok, present,
+		))
+	}
+}
@@ -0,0 +1,77 @@
+package memdb
+
+import (
+	"github.com/google/btree"
+	"github.com/nedscode/memdb/persist"
+
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// exported is a single line of an Export stream
+type exported struct {
+	UID  UID             `json:"uid"`
+	Type string          `json:"type"`
+	Item json.RawMessage `json:"item"`
+}
+
+// Export writes every item in the store, in order, to w as JSON lines, each line being an object with the item's uid,
+// type and the item itself
+// Items must be JSON marshallable. Exporting does not count as an access of the items.
+func (s *Store) Export(w io.Writer) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	enc := json.NewEncoder(w)
+
+	var err error
+	s.backing.Ascend(func(item btree.Item) bool {
+		wrapped, ok := item.(*wrap)
+		if !ok {
+			return true
+		}
+
+		var data []byte
+		data, err = json.Marshal(wrapped.item)
+		if err != nil {
+			err = fmt.Errorf("Items must be JSON marshallable to export: %s", err)
+			return false
+		}
+
+		err = enc.Encode(&exported{
+			UID:  wrapped.uid,
+			Type: fmt.Sprintf("%T", wrapped.item),
+			Item: data,
+		})
+		return err == nil
+	})
+	return err
+}
+
+// Import reads JSON lines as written by Export from r, and puts each of the items into the store
+// factory is called with each item's type name to instantiate a new instance for the item to be decoded into. Items
+// receive new UIDs when put.
+func (s *Store) Import(r io.Reader, factory persist.FactoryFunc) error {
+	dec := json.NewDecoder(r)
+	for {
+		var e exported
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to decode import line: %s", err)
+		}
+
+		item := factory(e.Type)
+		if item == nil {
+			return fmt.Errorf("Unable to get factory for type %s", e.Type)
+		}
+		if err := json.Unmarshal(e.Item, item); err != nil {
+			return fmt.Errorf("Unable to unmarshal item for type %s: %s", e.Type, err)
+		}
+
+		if _, err := s.Put(item); err != nil {
+			return err
+		}
+	}
+}
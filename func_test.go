@@ -4,13 +4,16 @@ import (
 	"github.com/google/btree"
 	"github.com/nedscode/memdb/persist"
 
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -124,6 +127,61 @@ func TestCreateField(t *testing.T) {
 	}
 }
 
+func TestLenIn(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.CreateIndex("c").Where(func(item interface{}) bool {
+		return item.(*X).A > 2
+	})
+
+	if !s.IsEmpty() {
+		t.Errorf("Expected new store to be empty")
+	}
+	for i := 1; i <= 5; i++ {
+		s.Put(&X{A: i, B: "b", C: fmt.Sprintf("c%d", i)})
+	}
+	if s.IsEmpty() {
+		t.Errorf("Expected store not to be empty")
+	}
+
+	if n := s.LenIn("b"); n != 5 {
+		t.Errorf("Expected 5 items in full index (got %d)", n)
+	}
+	if n := s.LenIn("c"); n != 3 {
+		t.Errorf("Expected 3 items in partial index (got %d)", n)
+	}
+	if n := s.LenIn("missing"); n != 0 {
+		t.Errorf("Expected 0 items in unknown index (got %d)", n)
+	}
+}
+
+func TestIndexInfo(t *testing.T) {
+	s := NewStore().PrimaryKey("make", "id")
+	s.CreateIndex("id").Unique()
+	s.CreateComputedIndex("band", func(item interface{}) string {
+		return fmt.Sprintf("%d", item.(*sale).Sales/1000)
+	}).Numeric()
+	s.CreateIndex("make").Where(func(item interface{}) bool {
+		return item.(*sale).Sales > 0
+	}).Ordered()
+
+	expected := []*IndexInfo{
+		{Name: "make\000id", Fields: []string{"make", "id"}, Unique: true, Primary: true},
+		{Name: "id", Fields: []string{"id"}, Unique: true},
+		{Name: "band", Fields: []string{"band"}, Computed: true, Numeric: true},
+		{Name: "make", Fields: []string{"make"}, Partial: true, Ordered: true},
+	}
+	if info := s.IndexInfo(); !reflect.DeepEqual(info, expected) {
+		for _, i := range info {
+			t.Errorf("Unexpected index info %#v", i)
+		}
+	}
+
+	if info := NewStore().IndexInfo(); len(info) != 0 {
+		t.Errorf("Expected no index info for a plain store (got %d)", len(info))
+	}
+}
+
 func TestCreateAfterStore(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -168,6 +226,183 @@ func TestPutAll(t *testing.T) {
 	}
 }
 
+// failingStorage is a plain Persister which fails to save items with a B of "fail"
+type failingStorage struct {
+	plainStorage
+}
+
+func (p *failingStorage) Save(id string, indexer interface{}) error {
+	if indexer.(*X).B == "fail" {
+		return fmt.Errorf("unable to save %d", indexer.(*X).A)
+	}
+	return p.plainStorage.Save(id, indexer)
+}
+
+func TestPutAllError(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b").Unique()
+	s.OnConflict("b", func(existing, incoming interface{}) bool {
+		return false
+	})
+	s.Persistent(&failingStorage{plainStorage{NewMockStorage()}})
+
+	var batch []Change
+	s.OnBatch(func(changes []Change) {
+		batch = changes
+	})
+
+	err := s.PutAll([]interface{}{
+		&X{A: 1, B: "one"},
+		&X{A: 2, B: "fail"},
+		&X{A: 3, B: "one"},
+		&X{A: 4, B: "four"},
+	})
+	s.Close()
+
+	putErr, ok := err.(*PutAllError)
+	if !ok || len(putErr.Failures) != 2 {
+		t.Fatalf("Expected 2 failures (got %#v)", err)
+	}
+	if f := putErr.Failures[0]; f.Index != 1 || !f.Stored || f.Err == nil {
+		t.Errorf("Expected item 1 to be stored but not persisted (got %#v)", f)
+	}
+	if f := putErr.Failures[1]; f.Index != 2 || f.Stored || f.Err != ErrConflict {
+		t.Errorf("Expected item 2 to be rejected by conflict (got %#v)", f)
+	}
+	if err.Error() != "2 errors occurred during operation" {
+		t.Errorf("Unexpected error message %q", err)
+	}
+
+	if len(batch) != 3 || batch[0].Err != nil || batch[1].Err == nil || batch[2].Err != nil {
+		t.Errorf("Expected only the unpersisted change to carry an error (got %#v)", batch)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := NewStore()
+	a.PrimaryKey("id")
+	a.Put(&anon{"a", 10})
+	a.Put(&anon{"b", 20})
+
+	b := NewStore()
+	b.PrimaryKey("id")
+	b.Put(&anon{"a", 5})
+	b.Put(&anon{"b", 30})
+	b.Put(&anon{"c", 40})
+
+	err := a.Merge(b.(*Store), func(existing, incoming interface{}) interface{} {
+		if incoming.(*anon).Value > existing.(*anon).Value {
+			return incoming
+		}
+		return existing
+	})
+	if err != nil {
+		t.Errorf("Unexpected error merging stores: %v", err)
+	}
+
+	order := ""
+	a.Ascend(func(i interface{}) bool {
+		order += fmt.Sprintf("%s%d,", i.(*anon).ID, i.(*anon).Value)
+		return true
+	})
+	if order != "a10,b30,c40," {
+		t.Errorf("Wrong items after merge, expected a10,b30,c40, (got %s)", order)
+	}
+
+	if err = a.Merge(a.(*Store), nil); err == nil {
+		t.Errorf("Expected error merging store into itself")
+	}
+
+	// Items which cannot be compared with == are stored by value
+	type labelled struct {
+		ID     string
+		Labels []string
+	}
+	c := NewStore().PrimaryKey("id")
+	c.Put(labelled{ID: "a", Labels: []string{"old"}})
+	d := NewStore().PrimaryKey("id")
+	d.Put(labelled{ID: "a", Labels: []string{"new"}})
+	d.Put(labelled{ID: "b"})
+	if err = c.Merge(d, func(existing, incoming interface{}) interface{} {
+		return existing
+	}); err != nil || c.Len() != 2 {
+		t.Errorf("Expected to merge uncomparable items (got %v, %d items)", err, c.Len())
+	}
+
+	// Merged items are checked as for Put
+	e := NewStore().PrimaryKey("id")
+	e.CreateIndex("value").Unique()
+	e.OnConflict("value", func(existing, incoming interface{}) bool {
+		return false
+	})
+	e.Put(&anon{"x", 30})
+	err = e.Merge(b.(*Store), nil)
+	if putErr, ok := err.(*PutAllError); !ok || len(putErr.Failures) != 1 || putErr.Failures[0].Index != 1 ||
+		putErr.Failures[0].Err != ErrConflict {
+		t.Errorf("Expected conflict for the second item (got %#v)", err)
+	}
+	e.Close()
+	if err = e.Merge(b.(*Store), nil); err != ErrClosed {
+		t.Errorf("Expected ErrClosed merging into closed store (got %v)", err)
+	}
+}
+
+func TestUpdateIf(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "cancelled"})
+	s.Put(&X{A: 2, B: "active"})
+	s.Put(&X{A: 3, B: "cancelled"})
+
+	n, err := s.UpdateIf(func(item interface{}) bool {
+		return item.(*X).B == "cancelled"
+	}, func(item interface{}) {
+		item.(*X).B = "archived"
+	})
+
+	if n != 2 || err != nil {
+		t.Errorf("Expected 2 items updated without error (got %d, %v)", n, err)
+	}
+	if vals := s.In("b").Lookup("cancelled"); vals != nil {
+		t.Errorf("Expected no cancelled items after update (got %#v)", vals)
+	}
+	if n := len(s.In("b").Lookup("archived")); n != 2 {
+		t.Errorf("Expected 2 archived items after update (got %d)", n)
+	}
+	if n := s.Len(); n != 3 {
+		t.Errorf("Expected 3 items in store (got %d)", n)
+	}
+
+	// Updates displace items in unique indexes, and are persisted under the same UIDs
+	u := NewStore()
+	u.CreateIndex("b").Unique()
+	storage := NewMockStorage()
+	u.Persistent(storage)
+	u.Put(&X{A: 1, B: "one"})
+	u.Put(&X{A: 2, B: "taken"})
+	uid, _ := u.UID(&X{A: 1})
+
+	n, err = u.UpdateIf(func(item interface{}) bool {
+		return item.(*X).A == 1
+	}, func(item interface{}) {
+		item.(*X).B = "taken"
+	})
+	if n != 1 || err != nil {
+		t.Errorf("Expected 1 item updated without error (got %d, %v)", n, err)
+	}
+	if u.Contains(&X{A: 2}) || u.Len() != 1 {
+		t.Errorf("Expected displaced item to be removed")
+	}
+	if after, _ := u.UID(&X{A: 1}); after != uid || len(storage.Store) != 1 {
+		t.Errorf("Expected update to be persisted under the same UID (got %s, %d records)", after, len(storage.Store))
+	}
+
+	u.Close()
+	if _, err = u.UpdateIf(func(item interface{}) bool { return true }, func(item interface{}) {}); err != ErrClosed {
+		t.Errorf("Expected ErrClosed updating closed store (got %v)", err)
+	}
+}
+
 func TestGet(t *testing.T) {
 	s := NewStore()
 	orig := &X{A: 1}
@@ -183,255 +418,632 @@ func TestGet(t *testing.T) {
 	}
 }
 
-func TestLookup(t *testing.T) {
+func TestModifiedSince(t *testing.T) {
 	s := NewStore()
-	s.CreateIndex("b")
-	s.Put(&X{A: 1, B: "test"})
-	s.Put(&X{A: 2, B: "test"})
-	s.Put(&X{A: 3, B: "not"})
-	vals := s.In("b").Lookup("test")
-	if len(vals) != 2 {
-		t.Errorf("Length of looked up values should be 2 (was %d)", len(vals))
+	s.Put(&X{A: 1})
+	s.Put(&X{A: 2})
+
+	mark := time.Now()
+	time.Sleep(time.Millisecond)
+
+	s.Put(&X{A: 3})
+	s.Put(&X{A: 1, B: "updated"})
+
+	got := ""
+	for _, item := range s.ModifiedSince(mark) {
+		got += fmt.Sprintf("%d", item.(*X).A)
 	}
-	a := vals[0].(*X)
-	b := vals[1].(*X)
-	if (a.A != 1 || b.A != 2) && (a.A != 2 || b.A != 1) {
-		t.Errorf("Expected to return 1 and 2 (got %#v)", vals)
+	if got != "13" {
+		t.Errorf("Expected items 1 and 3 to be modified since mark (got %s)", got)
 	}
+}
 
-	val := s.In("b").One("test").(*X)
-	if val.A != 1 && val.A != 2 {
-		t.Errorf("Expected One to return 1 or 2 (got %#v)", val)
+func TestEachModifiedSince(t *testing.T) {
+	s := NewStore()
+	s.Put(&X{A: 1})
+	s.Put(&X{A: 2})
+
+	mark := time.Now()
+	time.Sleep(time.Millisecond)
+
+	s.Put(&X{A: 3})
+	s.Put(&X{A: 1, B: "updated"})
+
+	got := ""
+	s.EachModifiedSince(mark, func(uid UID, item interface{}, stats Stats) bool {
+		if uid == "" || !stats.Modified.After(mark) {
+			t.Errorf("Expected uid and stats for modified item %#v", item)
+		}
+		got += fmt.Sprintf("%d", item.(*X).A)
+		return true
+	})
+	if got != "13" {
+		t.Errorf("Expected items 1 and 3 to be modified since mark (got %s)", got)
+	}
+
+	if _, stats, _ := s.GetWithStats(&X{A: 2}); stats.Reads != 1 {
+		t.Errorf("Expected only the Get to be counted as a read (got %d)", stats.Reads)
+	}
+
+	n := 0
+	s.EachModifiedSince(time.Time{}, func(uid UID, item interface{}, stats Stats) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Expected iteration to stop when callback returns false (got %d)", n)
 	}
 }
 
-func TestLookupInvalidField(t *testing.T) {
+func TestContains(t *testing.T) {
 	s := NewStore()
-	s.CreateIndex("b")
-	s.Put(&X{A: 1, B: "test"})
-	vals := s.In("c").Lookup("test")
-	if vals != nil {
-		t.Errorf("Lookup of invalid field should be nil (was %#v)", vals)
+	s.Put(&X{A: 1})
+
+	if !s.Contains(&X{A: 1}) {
+		t.Errorf("Expected store to contain item")
+	}
+	if s.Contains(&X{A: 2}) {
+		t.Errorf("Expected store not to contain missing item")
+	}
+	if s.Contains(nil) || s.Contains((*X)(nil)) {
+		t.Errorf("Expected store not to contain nil items")
 	}
 
-	vals = s.In("b").Lookup("dumb")
-	if vals != nil {
-		t.Errorf("Lookup of non-present key should be nil (was %#v)", vals)
+	_, stats, _ := s.GetWithStats(&X{A: 1})
+	if stats.Reads != 1 {
+		t.Errorf("Expected Contains not to record reads (got %d)", stats.Reads-1)
 	}
 }
 
-func TestTraverse(t *testing.T) {
+func TestVerifyRepair(t *testing.T) {
 	s := NewStore()
-	p := NewMockStorage()
-
 	s.CreateIndex("b")
-	s.CreateIndex("c")
-	s.Persistent(p)
-
-	v1 := &X{A: 1, B: "one:", C: "ZZZ"}
-	v2 := &X{A: 2, B: "two:", C: "ZZZ"}
-	v3 := &X{A: 3, B: "three:", C: "ZZZ"}
-	v4 := &X{A: 4, B: "four:", C: "XXX"}
-	v8 := &X{A: 8, B: "eight:", C: "ZZZ"}
+	s.Put(&X{A: 1, B: "one"})
+	s.Put(&X{A: 2, B: "two"})
 
-	s.Put(v1)
-	s.Put(v2)
-	s.Put(v4)
-	s.Put(v8)
+	if errs := s.Verify(); len(errs) != 0 {
+		t.Errorf("Expected consistent store (got %v)", errs)
+	}
 
-	t.Log(p.Store)
+	// Strand an item in the index and uid map, as if removed from the tree without being unindexed
+	st := s.(*Store)
+	st.backing.Delete(&wrap{storer: st, item: &X{A: 1}})
 
-	n := s.Len()
-	if n != 4 {
-		t.Errorf("Expected 4 items in length (got %d)", n)
+	if errs := s.Verify(); len(errs) != 2 {
+		t.Errorf("Expected index and uid inconsistencies (got %v)", errs)
 	}
-
-	n = len(p.Store)
-	if n != 4 {
-		t.Errorf("Expected 4 items in persitent store (got %d)", n)
+	if n := s.Repair(); n != 2 {
+		t.Errorf("Expected 2 entries to be repaired (got %d)", n)
+	}
+	if errs := s.Verify(); len(errs) != 0 {
+		t.Errorf("Expected consistent store after repair (got %v)", errs)
+	}
+	if got := s.In("b").Lookup("one"); len(got) != 0 {
+		t.Errorf("Expected orphaned index entry to be removed (got %#v)", got)
 	}
+}
 
-	k := s.Keys("b")
-	if len(k) != 4 {
-		t.Errorf("Expected 4 items in keys for field (got %#v)", k)
+func TestGetWithStats(t *testing.T) {
+	s := NewStore()
+	orig := &X{A: 1}
+	s.Put(orig)
+	s.Get(&X{A: 1})
+
+	v, stats, ok := s.GetWithStats(&X{A: 1})
+	if !ok || v != orig {
+		t.Errorf("Expected GetWithStats to find original instance (got %#v)", v)
+	}
+	if stats.Reads != 2 || stats.Writes != 1 {
+		t.Errorf("Expected 2 reads and 1 write (got %d and %d)", stats.Reads, stats.Writes)
+	}
+	if stats.w != nil || stats.IsZero() {
+		t.Errorf("Expected detached, non-zero stats")
 	}
 
-	sort.Strings(k)
-	j := strings.Join(k, "")
-	if j != "eight:four:one:two:" {
-		t.Errorf("Unexpected items in keys for field (got %s)", j)
+	if _, _, ok = s.GetWithStats(&X{A: 2}); ok {
+		t.Errorf("Expected GetWithStats not to find missing item")
 	}
+	if _, _, ok = s.GetWithStats((*X)(nil)); ok {
+		t.Errorf("Expected GetWithStats not to find nil item")
+	}
+}
 
-	var got, expect string
-	var stop *X
+func TestUID(t *testing.T) {
+	s := NewStore()
+	orig := &X{A: 1}
+	s.Put(orig)
 
-	iter := func(i interface{}) bool {
-		got += i.(*X).B
-		return i != stop
+	uid, ok := s.UID(&X{A: 1})
+	if !ok || uid == "" {
+		t.Errorf("Expected to find UID of stored item")
 	}
 
-	performTraversals(t, s, iter, &got, &stop, v2, v3, v4)
+	if v := s.GetByUID(uid); v != orig {
+		t.Errorf("Expected GetByUID to return original instance (got %#v)", v)
+	}
 
-	expired = 4
-	now := time.Now()
-	if !v4.IsExpired(now, Stats{}) {
-		t.Errorf("Expected v4 to be expired")
+	if _, ok = s.UID(&X{A: 2}); ok {
+		t.Errorf("Expected not to find UID of missing item")
 	}
 
-	s.Expire()
+	s.Delete(orig)
+	if v := s.GetByUID(uid); v != nil {
+		t.Errorf("Expected GetByUID to return nil after delete (got %#v)", v)
+	}
+}
 
-	got = ""
-	stop = nil
-	s.Ascend(iter)
-	expect = "one:two:eight:"
-	if got != expect {
-		t.Errorf("Expired item not removed expected %s (got %s)", expect, got)
+func TestDecodeUID(t *testing.T) {
+	before := time.Now()
+	uid := NewUID()
+	after := time.Now()
+
+	got, err := DecodeUID(string(uid))
+	if err != nil {
+		t.Errorf("Unexpected error decoding %s: %s", uid, err)
+	}
+	if got.Before(before.Add(-2*time.Millisecond)) || got.After(after) {
+		t.Errorf("Expected decoded time between %v and %v (got %v)", before, after, got)
+	}
+	if !uid.Time().Equal(got) {
+		t.Errorf("Expected Time to match DecodeUID (got %v)", uid.Time())
 	}
 
-	vals := s.In("b").Lookup("four")
-	if vals != nil {
-		t.Errorf("Expired item found by field (got %#v)", vals)
+	for _, bad := range []string{"", "short", "0123456789ab", "ABCDEFGHJKLMN"} {
+		if _, err = DecodeUID(bad); err == nil {
+			t.Errorf("Expected error decoding malformed UID %q", bad)
+		}
+	}
+	if !UID("short").Time().IsZero() {
+		t.Errorf("Expected zero time for malformed UID")
 	}
+}
 
-	n = len(p.Store)
-	if n != 3 {
-		t.Errorf("Expected 3 items in persitent store (got %d)", n)
+func TestNewUIDUnique(t *testing.T) {
+	seen := map[UID]bool{}
+	var last UID
+	for i := 0; i < 100000; i++ {
+		uid := NewUID()
+		if seen[uid] {
+			t.Fatalf("Expected unique UIDs, %s repeated after %d", uid, i)
+		}
+		if len(uid) != 12 || uid <= last {
+			t.Fatalf("Expected 12 character UIDs in increasing order (got %s after %s)", uid, last)
+		}
+		seen[uid] = true
+		last = uid
 	}
+}
 
-	s.Delete(v2)
+func TestPutWithResult(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("c").Unique()
 
-	got = ""
-	s.Ascend(iter)
-	expect = "one:eight:"
-	if got != expect {
-		t.Errorf("Deleted item not removed expected %s (got %s)", expect, got)
+	res, err := s.PutWithResult(&X{A: 1, C: "one"})
+	if err != nil || res.Action != Inserted || res.Old != nil || res.Replaced != nil {
+		t.Errorf("Expected insert (got %#v, %v)", res, err)
 	}
 
-	n = len(p.Store)
-	if n != 2 {
-		t.Errorf("Expected 2 items in persitent store (got %d)", n)
+	res, _ = s.PutWithResult(&X{A: 1, B: "updated", C: "one"})
+	if res.Action != Updated || res.Old.(*X).B != "" || res.Replaced != nil {
+		t.Errorf("Expected update of equal item (got %#v)", res)
 	}
 
-	verifyPersistentStore(p, t)
-
-	s2 := NewStore()
-	s2.Persistent(p)
-
-	n = s2.Len()
-	if n != 2 {
-		t.Errorf("Expected 2 items in new store (got %d)", n)
+	res, _ = s.PutWithResult(&X{A: 2, C: "one"})
+	if res.Action != ReplacedByUnique || res.Old != nil || len(res.Replaced) != 1 || res.Replaced[0].(*X).A != 1 {
+		t.Errorf("Expected replacement via unique index (got %#v)", res)
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expected replaced item to be removed (got %d items)", s.Len())
 	}
 
-	got = ""
-	s.Ascend(iter)
-	expect = "one:eight:"
-	if got != expect {
-		t.Errorf("Wrong items found in new store expected %s (got %s)", expect, got)
+	s.Close()
+	if _, err = s.PutWithResult(&X{A: 3}); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after close (got %v)", err)
 	}
 }
 
-func verifyPersistentStore(p *Storage, t *testing.T) {
-	foundOne := false
-	foundEight := false
-	foundOther := false
-
-	for _, d := range p.Store {
-		v := &X{}
-		err := json.Unmarshal(d, v)
-		t.Logf("Data to json: %#v", v)
-		if err != nil {
-			t.Errorf("Error unmarshaling data: %v", err)
-		}
+func TestReserve(t *testing.T) {
+	s := NewStore().StrictKeys(true)
+	s.CreateIndex("b")
+	s.Reserve(100)
+	s.CreateIndex("c")
 
-		if v.A == 1 {
-			foundOne = true
-		} else if v.A == 8 {
-			foundEight = true
-		} else {
-			foundOther = true
-		}
+	items := make([]interface{}, 100)
+	for i := range items {
+		items[i] = &X{A: i, B: fmt.Sprintf("b%d", i%10), C: fmt.Sprintf("c%d", i)}
+	}
+	if err := s.PutAll(items); err != nil {
+		t.Errorf("Unexpected error putting items: %s", err)
 	}
 
-	if !foundOne || !foundEight || foundOther {
-		t.Errorf("Wrong items found in persistent store, %t %t %t", foundOne, foundEight, foundOther)
+	if s.Len() != 100 || s.IndexCardinality("b") != 10 || s.IndexCardinality("c") != 100 {
+		t.Errorf("Expected reserved store to hold all items (got %d)", s.Len())
 	}
-}
 
-func performTraversals(
-	t *testing.T,
-	s Storer,
-	iter func(i interface{}) bool,
-	got *string,
-	stop **X,
-	v2 *X,
-	v3 *X,
-	v4 *X,
-) {
-	*got = ""
-	s.Ascend(iter)
-	expect := "one:two:four:eight:"
-	if *got != expect {
-		t.Errorf("Traversed in wrong direction expected %s (got %s)", expect, *got)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Expected panic reserving on in-use store")
+		}
+	}()
+	s.Reserve(10)
+}
+
+func TestOnSize(t *testing.T) {
+	s := NewStore()
+
+	var (
+		mu        sync.Mutex
+		crossings []string
+	)
+	s.OnSize(3, 2, func(count int, rising bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		crossings = append(crossings, fmt.Sprintf("%d:%t", count, rising))
+	})
+
+	for i := 1; i <= 5; i++ {
+		s.Put(&X{A: i})
 	}
+	// Falling to 3 or 2 is not below low, so rising back to 4 is not a new crossing
+	s.Delete(&X{A: 5})
+	s.Delete(&X{A: 4})
+	s.Delete(&X{A: 3})
+	s.Put(&X{A: 3})
+	s.Put(&X{A: 4})
+	s.Clear()
+	s.PutAll([]interface{}{&X{A: 1}, &X{A: 2}, &X{A: 3}, &X{A: 4}})
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(crossings, ","); got != "4:true,0:false,4:true" {
+		t.Errorf("Expected crossings with hysteresis (got %s)", got)
+	}
+}
 
-	*got = ""
-	s.Descend(iter)
-	expect = "eight:four:two:one:"
-	if *got != expect {
-		t.Errorf("Traversed in wrong direction expected %s (got %s)", expect, *got)
+func TestOnConflict(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b").Unique()
+	s.CreateIndex("c")
+
+	var conflicts int
+	s.OnConflict("b", func(existing, incoming interface{}) bool {
+		conflicts++
+		return incoming.(*X).C == "override"
+	})
+
+	s.Put(&X{A: 1, B: "sku"})
+	if _, err := s.Put(&X{A: 2, B: "sku"}); err != ErrConflict {
+		t.Errorf("Expected conflicting put to be rejected (got %v)", err)
+	}
+	if v := s.In("b").One("sku"); v == nil || v.(*X).A != 1 {
+		t.Errorf("Expected first write to win (got %#v)", v)
 	}
 
-	*got = ""
-	s.DescendStarting(v3, iter)
-	expect = "two:one:"
-	if *got != expect {
-		t.Errorf("Traversed in wrong direction expected %s (got %s)", expect, *got)
+	if _, err := s.Put(&X{A: 1, B: "sku", C: "updated"}); err != nil {
+		t.Errorf("Expected update of equal item not to conflict (got %v)", err)
+	}
+	if err := s.PutAll([]interface{}{&X{A: 3, B: "sku"}, &X{A: 4, B: "other"}}); err == nil {
+		t.Errorf("Expected PutAll to report rejected item")
+	}
+	if _, err := s.Put(&X{A: 5, B: "sku", C: "override"}); err != nil {
+		t.Errorf("Expected handler to allow replacement (got %v)", err)
+	}
+	if v := s.In("b").One("sku"); v == nil || v.(*X).A != 5 {
+		t.Errorf("Expected replacement to be stored (got %#v)", v)
+	}
+	if conflicts != 3 || s.Len() != 2 {
+		t.Errorf("Expected 3 conflicts and 2 items (got %d and %d)", conflicts, s.Len())
 	}
 
-	*got = ""
-	s.AscendStarting(v3, iter)
-	expect = "four:eight:"
-	if *got != expect {
-		t.Errorf("Traversed in wrong direction expected %s (got %s)", expect, *got)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Expected panic setting conflict handler on non-unique index")
+		}
+	}()
+	s.OnConflict("c", nil)
+}
+
+func TestStoreStats(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Persistent(NewMockStorage())
+
+	start := time.Now()
+	s.Put(&X{A: 1, B: "one"})
+	s.Put(&X{A: 2, B: "two"})
+	s.Put(&X{A: 2, B: "two"})
+	s.Get(&X{A: 1})
+
+	ss := s.StoreStats()
+	if ss.Items != 2 || ss.Indexes != 1 {
+		t.Errorf("Expected 2 items and 1 index (got %d and %d)", ss.Items, ss.Indexes)
+	}
+	if ss.TotalReads != 1 || ss.TotalWrites != 3 {
+		t.Errorf("Expected 1 read and 3 writes (got %d and %d)", ss.TotalReads, ss.TotalWrites)
 	}
+	if ss.TotalSize == 0 {
+		t.Errorf("Expected non-zero total size")
+	}
+	if ss.OldestCreated.Before(start) || ss.NewestModified.Before(ss.OldestCreated) {
+		t.Errorf("Unexpected times oldest %v newest %v", ss.OldestCreated, ss.NewestModified)
+	}
+}
 
-	*got = ""
-	*stop = v2
-	s.Ascend(iter)
-	expect = "one:two:"
-	if *got != expect {
-		t.Errorf("Traversal didn't stop expected %s (got %s)", expect, *got)
+func TestSetUIDFunc(t *testing.T) {
+	storage := NewMockStorage()
+	s := NewStore().SetUIDFunc(func(item interface{}) UID {
+		return UID(item.(*X).B)
+	})
+	s.Persistent(storage)
+
+	if _, err := s.Put(&X{A: 1, B: "sku-1"}); err != nil {
+		t.Errorf("Unexpected error putting item: %s", err)
+	}
+	if _, err := s.Put(&X{A: 1, B: "sku-1", C: "updated"}); err != nil {
+		t.Errorf("Unexpected error re-putting item: %s", err)
 	}
 
-	*got = ""
-	*stop = v4
-	s.Descend(iter)
-	expect = "eight:four:"
-	if *got != expect {
-		t.Errorf("Traversal didn't stop expected %s (got %s)", expect, *got)
+	if uid, _ := s.UID(&X{A: 1}); uid != "sku-1" {
+		t.Errorf("Expected UID from func (got %s)", uid)
+	}
+	if v := s.GetByUID("sku-1"); v == nil || v.(*X).C != "updated" {
+		t.Errorf("Expected GetByUID to find updated item (got %#v)", v)
+	}
+	if len(storage.Store) != 1 {
+		t.Errorf("Expected re-put to overwrite persisted item (got %d items)", len(storage.Store))
 	}
 
-	*got = ""
-	*stop = v4
-	s.AscendStarting(v3, iter)
-	expect = "four:"
-	if *got != expect {
-		t.Errorf("Traversal didn't stop expected %s (got %s)", expect, *got)
+	if _, err := s.Put(&X{A: 2, B: "sku-1"}); err == nil {
+		t.Errorf("Expected error putting different item with duplicate UID")
+	}
+	if _, err := s.Put(&X{A: 3}); err == nil {
+		t.Errorf("Expected error putting item with empty UID")
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expected rejected items not to be stored (got %d)", s.Len())
 	}
+}
 
-	*got = ""
-	*stop = v2
-	s.DescendStarting(v3, iter)
-	expect = "two:"
-	if *got != expect {
-		t.Errorf("Traversal didn't stop expected %s (got %s)", expect, *got)
+func TestNoUID(t *testing.T) {
+	s := NewStore().NoUID()
+	s.Put(&X{A: 1})
+
+	s.Info(func(uid UID, _ interface{}, _ Stats) bool {
+		if uid != "" {
+			t.Errorf("Expected no UID to be generated (got %s)", uid)
+		}
+		return true
+	})
+
+	p := NewStore().NoUID()
+	p.Persistent(NewMockStorage())
+	p.Put(&X{A: 1})
+	if uid, ok := p.UID(&X{A: 1}); !ok || uid == "" {
+		t.Errorf("Expected UID to be generated for persistent store")
+	}
+
+	if uid, ok := s.UID(&X{A: 1}); ok || uid != "" {
+		t.Errorf("Expected no UID to be found with UIDs disabled (got %s)", uid)
+	}
+	if v := s.GetByUID(""); v != nil {
+		t.Errorf("Expected GetByUID not to find items with UIDs disabled (got %#v)", v)
 	}
 }
 
-func TestEach(t *testing.T) {
+func TestReplace(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	storage := NewMockStorage()
+	s.Persistent(storage)
+	s.Put(&X{A: 1, B: "one"})
+	s.Put(&X{A: 3, B: "three"})
+	s.Get(&X{A: 1})
+	uid, _ := s.UID(&X{A: 1})
+	_, before, _ := s.GetWithStats(&X{A: 1})
+
+	if err := s.Replace(&X{A: 1}, &X{A: 2, B: "two"}); err != nil {
+		t.Fatalf("Unexpected error replacing: %s", err)
+	}
+
+	if s.Contains(&X{A: 1}) || s.In("b").One("one") != nil {
+		t.Errorf("Expected old item to be gone")
+	}
+	if newUID, _ := s.UID(&X{A: 2}); newUID != uid {
+		t.Errorf("Expected UID %s to be kept (got %s)", uid, newUID)
+	}
+	info, _ := s.Inspect(&X{A: 2})
+	if !info.Stats.Created.Equal(before.Created) || info.Stats.Writes != 2 || info.Stats.Reads != before.Reads {
+		t.Errorf("Expected stats to be kept (before %#v, after %#v)", before, info.Stats)
+	}
+	if len(storage.Store) != 2 || !strings.Contains(string(storage.Store[string(uid)]), `"B":"two"`) {
+		t.Errorf("Expected persisted record to be overwritten (got %#v)", storage.Store)
+	}
+
+	if err := s.Replace(&X{A: 9}, &X{A: 10}); err == nil {
+		t.Errorf("Expected error replacing missing item")
+	}
+
+	s = NewStore()
+	s.CreateIndex("b").Unique()
+	s.OnConflict("b", func(existing, incoming interface{}) bool {
+		return false
+	})
+	s.Put(&X{A: 1, B: "one"})
+	s.Put(&X{A: 3, B: "three"})
+
+	if err := s.Replace(&X{A: 1}, &X{A: 2, B: "three"}); err != ErrConflict {
+		t.Errorf("Expected conflict replacing with another item's unique key (got %v)", err)
+	}
+	if !s.Contains(&X{A: 1}) || s.Contains(&X{A: 2}) || s.In("b").One("three").(*X).A != 3 {
+		t.Errorf("Expected store to be unchanged by a conflicting replace")
+	}
+	if err := s.Replace(&X{A: 1}, &X{A: 2, B: "one"}); err != nil {
+		t.Errorf("Expected the replaced item's own unique key not to conflict (got %v)", err)
+	}
+}
+
+func TestGetOrPut(t *testing.T) {
+	s := NewStore()
+
+	var created int64
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				s.GetOrPut(&X{A: i}, func() interface{} {
+					atomic.AddInt64(&created, 1)
+					return &X{A: i, B: "created"}
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created != 50 {
+		t.Errorf("Expected each item to be created exactly once (got %d)", created)
+	}
+
+	v, loaded, err := s.GetOrPut(&X{A: 1}, nil)
+	if err != nil || !loaded || v.(*X).B != "created" {
+		t.Errorf("Expected existing item to be loaded (got %#v, %t, %v)", v, loaded, err)
+	}
+	v, loaded, _ = s.GetOrPut(&X{A: 100, B: "given"}, nil)
+	if loaded || v.(*X).B != "given" || !s.Contains(&X{A: 100}) {
+		t.Errorf("Expected given item to be inserted (got %#v, %t)", v, loaded)
+	}
+}
+
+func TestGetAndDelete(t *testing.T) {
+	s := NewStore()
+	for i := 0; i < 100; i++ {
+		s.Put(&X{A: i})
+	}
+
+	var wg sync.WaitGroup
+	var claimed int64
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, ok := s.GetAndDelete(&X{A: i}); ok {
+					atomic.AddInt64(&claimed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if claimed != 100 {
+		t.Errorf("Expected each item to be claimed exactly once (got %d claims)", claimed)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Expected store to be empty (got %d)", n)
+	}
+}
+
+func TestDeleteIf(t *testing.T) {
+	s := NewStore()
+	s.Put(&X{A: 1, B: "v1"})
+
+	isV2 := func(current interface{}) bool {
+		return current.(*X).B == "v2"
+	}
+
+	old, deleted, err := s.DeleteIf(&X{A: 1}, isV2)
+	if old != nil || deleted || err != nil {
+		t.Errorf("Expected no delete when condition fails (got %#v %t %v)", old, deleted, err)
+	}
+
+	s.Put(&X{A: 1, B: "v2"})
+	old, deleted, err = s.DeleteIf(&X{A: 1}, isV2)
+	if old == nil || !deleted || err != nil {
+		t.Errorf("Expected delete when condition passes (got %#v %t %v)", old, deleted, err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Expected empty store after conditional delete (got %d)", n)
+	}
+
+	if _, deleted, _ = s.DeleteIf(&X{A: 1}, isV2); deleted {
+		t.Errorf("Expected no delete of missing item")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "test"})
+	s.Put(&X{A: 2, B: "test"})
+	s.Put(&X{A: 3, B: "not"})
+	vals := s.In("b").Lookup("test")
+	if len(vals) != 2 {
+		t.Errorf("Length of looked up values should be 2 (was %d)", len(vals))
+	}
+	a := vals[0].(*X)
+	b := vals[1].(*X)
+	if (a.A != 1 || b.A != 2) && (a.A != 2 || b.A != 1) {
+		t.Errorf("Expected to return 1 and 2 (got %#v)", vals)
+	}
+
+	val := s.In("b").One("test").(*X)
+	if val.A != 1 && val.A != 2 {
+		t.Errorf("Expected One to return 1 or 2 (got %#v)", val)
+	}
+}
+
+func TestIndexStats(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "test"})
+	s.Put(&X{A: 2, B: "test"})
+	s.Put(&X{A: 2, B: "test"})
+
+	stats := s.In("b").Stats("test")
+	if n := len(stats); n != 2 {
+		t.Fatalf("Expected stats for 2 items (got %d)", n)
+	}
+
+	writes := stats[0].Writes + stats[1].Writes
+	if writes != 3 {
+		t.Errorf("Expected 3 total writes (got %d)", writes)
+	}
+	if stats[0].w != nil || stats[1].w != nil {
+		t.Errorf("Expected stats to be detached copies")
+	}
+
+	if stats = s.In("b").Stats("missing"); stats != nil {
+		t.Errorf("Expected nil stats for missing key (got %#v)", stats)
+	}
+	if stats = s.In("c").Stats("test"); stats != nil {
+		t.Errorf("Expected nil stats for missing index (got %#v)", stats)
+	}
+}
+
+func TestLookupInvalidField(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "test"})
+	vals := s.In("c").Lookup("test")
+	if vals != nil {
+		t.Errorf("Lookup of invalid field should be nil (was %#v)", vals)
+	}
+
+	vals = s.In("b").Lookup("dumb")
+	if vals != nil {
+		t.Errorf("Lookup of non-present key should be nil (was %#v)", vals)
+	}
+}
+
+func TestTraverse(t *testing.T) {
 	s := NewStore()
+	p := NewMockStorage()
+
 	s.CreateIndex("b")
 	s.CreateIndex("c")
+	s.Persistent(p)
 
 	v1 := &X{A: 1, B: "one:", C: "ZZZ"}
 	v2 := &X{A: 2, B: "two:", C: "ZZZ"}
@@ -441,138 +1053,2126 @@ func TestEach(t *testing.T) {
 
 	s.Put(v1)
 	s.Put(v2)
-	s.Put(v3)
 	s.Put(v4)
 	s.Put(v8)
 
-	total := 0
-	s.In("c").Each(func(i interface{}) bool {
-		total += i.(*X).A
-		return true
-	}, "ZZZ")
+	t.Log(p.Store)
 
-	if total != 14 {
-		t.Errorf("Expected total of 14 when adding up matching ZZZ items (got %d)", total)
+	n := s.Len()
+	if n != 4 {
+		t.Errorf("Expected 4 items in length (got %d)", n)
+	}
+
+	n = len(p.Store)
+	if n != 4 {
+		t.Errorf("Expected 4 items in persitent store (got %d)", n)
+	}
+
+	k := s.Keys("b")
+	if len(k) != 4 {
+		t.Errorf("Expected 4 items in keys for field (got %#v)", k)
+	}
+
+	sort.Strings(k)
+	j := strings.Join(k, "")
+	if j != "eight:four:one:two:" {
+		t.Errorf("Unexpected items in keys for field (got %s)", j)
+	}
+
+	var got, expect string
+	var stop *X
+
+	iter := func(i interface{}) bool {
+		got += i.(*X).B
+		return i != stop
+	}
+
+	performTraversals(t, s, iter, &got, &stop, v2, v3, v4)
+
+	expired = 4
+	now := time.Now()
+	if !v4.IsExpired(now, Stats{}) {
+		t.Errorf("Expected v4 to be expired")
+	}
+
+	s.Expire()
+
+	got = ""
+	stop = nil
+	s.Ascend(iter)
+	expect = "one:two:eight:"
+	if got != expect {
+		t.Errorf("Expired item not removed expected %s (got %s)", expect, got)
+	}
+
+	vals := s.In("b").Lookup("four")
+	if vals != nil {
+		t.Errorf("Expired item found by field (got %#v)", vals)
+	}
+
+	n = len(p.Store)
+	if n != 3 {
+		t.Errorf("Expected 3 items in persitent store (got %d)", n)
+	}
+
+	s.Delete(v2)
+
+	got = ""
+	s.Ascend(iter)
+	expect = "one:eight:"
+	if got != expect {
+		t.Errorf("Deleted item not removed expected %s (got %s)", expect, got)
+	}
+
+	n = len(p.Store)
+	if n != 2 {
+		t.Errorf("Expected 2 items in persitent store (got %d)", n)
+	}
+
+	verifyPersistentStore(p, t)
+
+	s2 := NewStore()
+	s2.Persistent(p)
+
+	n = s2.Len()
+	if n != 2 {
+		t.Errorf("Expected 2 items in new store (got %d)", n)
+	}
+
+	got = ""
+	s.Ascend(iter)
+	expect = "one:eight:"
+	if got != expect {
+		t.Errorf("Wrong items found in new store expected %s (got %s)", expect, got)
+	}
+}
+
+func verifyPersistentStore(p *Storage, t *testing.T) {
+	foundOne := false
+	foundEight := false
+	foundOther := false
+
+	for _, d := range p.Store {
+		v := &X{}
+		err := json.Unmarshal(d, v)
+		t.Logf("Data to json: %#v", v)
+		if err != nil {
+			t.Errorf("Error unmarshaling data: %v", err)
+		}
+
+		if v.A == 1 {
+			foundOne = true
+		} else if v.A == 8 {
+			foundEight = true
+		} else {
+			foundOther = true
+		}
+	}
+
+	if !foundOne || !foundEight || foundOther {
+		t.Errorf("Wrong items found in persistent store, %t %t %t", foundOne, foundEight, foundOther)
+	}
+}
+
+func performTraversals(
+	t *testing.T,
+	s Storer,
+	iter func(i interface{}) bool,
+	got *string,
+	stop **X,
+	v2 *X,
+	v3 *X,
+	v4 *X,
+) {
+	*got = ""
+	s.Ascend(iter)
+	expect := "one:two:four:eight:"
+	if *got != expect {
+		t.Errorf("Traversed in wrong direction expected %s (got %s)", expect, *got)
+	}
+
+	*got = ""
+	s.Descend(iter)
+	expect = "eight:four:two:one:"
+	if *got != expect {
+		t.Errorf("Traversed in wrong direction expected %s (got %s)", expect, *got)
+	}
+
+	*got = ""
+	s.DescendStarting(v3, iter)
+	expect = "two:one:"
+	if *got != expect {
+		t.Errorf("Traversed in wrong direction expected %s (got %s)", expect, *got)
+	}
+
+	*got = ""
+	s.AscendStarting(v3, iter)
+	expect = "four:eight:"
+	if *got != expect {
+		t.Errorf("Traversed in wrong direction expected %s (got %s)", expect, *got)
+	}
+
+	*got = ""
+	*stop = v2
+	s.Ascend(iter)
+	expect = "one:two:"
+	if *got != expect {
+		t.Errorf("Traversal didn't stop expected %s (got %s)", expect, *got)
+	}
+
+	*got = ""
+	*stop = v4
+	s.Descend(iter)
+	expect = "eight:four:"
+	if *got != expect {
+		t.Errorf("Traversal didn't stop expected %s (got %s)", expect, *got)
+	}
+
+	*got = ""
+	*stop = v4
+	s.AscendStarting(v3, iter)
+	expect = "four:"
+	if *got != expect {
+		t.Errorf("Traversal didn't stop expected %s (got %s)", expect, *got)
+	}
+
+	*got = ""
+	*stop = v2
+	s.DescendStarting(v3, iter)
+	expect = "two:"
+	if *got != expect {
+		t.Errorf("Traversal didn't stop expected %s (got %s)", expect, *got)
+	}
+}
+
+func TestKeysSorted(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "ford"})
+	s.Put(&X{A: 2, B: "holden"})
+	s.Put(&X{A: 3, B: "audi"})
+	s.Put(&X{A: 4, B: "ford"})
+
+	if j := strings.Join(s.KeysSorted("b"), ","); j != "audi,ford,holden" {
+		t.Errorf("Expected sorted keys audi,ford,holden (got %s)", j)
+	}
+
+	got := ""
+	s.EachKey(func(key string, count int) bool {
+		got += fmt.Sprintf("%s=%d,", key, count)
+		return key != "ford"
+	}, "b")
+	if got != "audi=1,ford=2," {
+		t.Errorf("Expected EachKey to stop after ford (got %s)", got)
+	}
+
+	r := NewStore().CreateIndex("b").Reversed()
+	r.Put(&X{A: 1, B: "ford"})
+	r.Put(&X{A: 2, B: "holden"})
+	r.Put(&X{A: 3, B: "audi"})
+
+	if j := strings.Join(r.KeysSorted("b"), ","); j != "holden,ford,audi" {
+		t.Errorf("Expected reversed sorted keys holden,ford,audi (got %s)", j)
+	}
+}
+
+func TestBucketSizes(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "ford"})
+	s.Put(&X{A: 2, B: "ford"})
+	s.Put(&X{A: 3, B: "holden"})
+	s.Put(&X{A: 4, B: "kia"})
+	s.Delete(&X{A: 4})
+
+	if n := s.IndexCardinality("b"); n != 2 {
+		t.Errorf("Expected cardinality of 2 (got %d)", n)
+	}
+
+	sizes := s.BucketSizes("b")
+	if len(sizes) != 2 || sizes["ford"] != 2 || sizes["holden"] != 1 {
+		t.Errorf("Unexpected bucket sizes (got %#v)", sizes)
+	}
+
+	if n := s.IndexCardinality("c"); n != 0 {
+		t.Errorf("Expected cardinality of 0 for unknown index (got %d)", n)
+	}
+	if sizes = s.BucketSizes("c"); sizes != nil {
+		t.Errorf("Expected nil bucket sizes for unknown index (got %#v)", sizes)
+	}
+}
+
+func TestIndexMemoryEstimate(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.CreateIndex("b", "c")
+	s.Put(&X{A: 1, B: "ford", C: "x"})
+	s.Put(&X{A: 2, B: "ford", C: "y"})
+	s.Put(&X{A: 3, B: "kia", C: "x"})
+
+	est := s.IndexMemoryEstimate()
+	if len(est) != 2 {
+		t.Errorf("Expected an estimate for each index (got %#v)", est)
+	}
+	if n := est["b"]; n != uint64(len("ford")+len("kia")+3*pointerSize) {
+		t.Errorf("Unexpected estimate for b (got %d)", n)
+	}
+	if est["b\000c"] <= est["b"] {
+		t.Errorf("Expected compound index to have longer keys (got %#v)", est)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	s := NewStore()
+	s.PrimaryKey("id")
+	s.CreateIndex("value")
+
+	var logged []string
+	s.SetLogger(func(level, msg string, kv ...interface{}) {
+		logged = append(logged, fmt.Sprintf("%s: %s %v", level, msg, kv[1]))
+	})
+
+	s.Put(&anon{"a", 10})
+	s.Put(&anon{"", 20})
+
+	if len(logged) != 1 || logged[0] != "warn: index key resolved empty [id]" {
+		t.Errorf("Expected a single empty key warning (got %#v)", logged)
+	}
+}
+
+func TestIndexRange(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.CreateIndex("b", "c")
+	s.Put(&X{A: 1, B: "09:30", C: "x"})
+	s.Put(&X{A: 2, B: "08:59", C: "x"})
+	s.Put(&X{A: 3, B: "10:00", C: "y"})
+	s.Put(&X{A: 4, B: "09:00", C: "y"})
+	s.Put(&X{A: 5, B: "10:01", C: "x"})
+
+	got := ""
+	iter := func(i interface{}) bool {
+		got += fmt.Sprintf("%d", i.(*X).A)
+		return true
+	}
+
+	s.IndexRange([]string{"b"}, []string{"09:00"}, []string{"10:00"}, iter)
+	if got != "413" {
+		t.Errorf("Expected range to return 413 (got %s)", got)
+	}
+
+	got = ""
+	s.IndexRange([]string{"b", "c"}, []string{"09:00", "z"}, []string{"10:00", "y"}, iter)
+	if got != "13" {
+		t.Errorf("Expected compound range to return 13 (got %s)", got)
+	}
+
+	got = ""
+	s.Delete(&X{A: 1})
+	s.IndexRange([]string{"b"}, []string{"09:00"}, []string{"10:00"}, func(i interface{}) bool {
+		iter(i)
+		return false
+	})
+	if got != "4" {
+		t.Errorf("Expected range to stop after 4 (got %s)", got)
+	}
+}
+
+func TestAllIndexStats(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.CreateIndex("b", "c")
+	s.Persistent(NewMockStorage())
+	s.Put(&X{A: 1, B: "one", C: "x"})
+	s.Put(&X{A: 2, B: "one", C: "y"})
+
+	all := s.AllIndexStats()
+	if n := len(all); n != 2 {
+		t.Fatalf("Expected stats for 2 indexes (got %d)", n)
+	}
+
+	b := all["b"]
+	if len(b) != 1 || b[0].Count != 2 || b[0].Size == 0 {
+		t.Errorf("Unexpected stats for index b (got %#v)", b)
+	}
+	if bc := all["b\000c"]; len(bc) != 2 {
+		t.Errorf("Expected 2 keys in compound index stats (got %d)", len(bc))
+	}
+}
+
+func TestIndexByID(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("c")
+	s.CreateIndex("b", "c")
+	s.Put(&X{A: 1, B: "one", C: "x"})
+
+	ids := s.IndexIDs()
+	if len(ids) != 2 || ids[0] != "b\000c" || ids[1] != "c" {
+		t.Fatalf("Unexpected index ids (got %q)", ids)
+	}
+
+	if x := s.IndexByID(ids[0]).One("one", "x"); x == nil || x.(*X).A != 1 {
+		t.Errorf("Expected to find item via index id (got %#v)", x)
+	}
+	if x := s.IndexByID("missing").One("one"); x != nil {
+		t.Errorf("Expected nothing from missing index (got %#v)", x)
+	}
+}
+
+func TestReader(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "one"})
+
+	r := s.Reader()
+	if r.Len() != 1 || r.In("b").One("one") == nil || r.Get(&X{A: 1}) == nil {
+		t.Errorf("Expected reader to query the store")
+	}
+}
+
+func TestLockFunc(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "parent"})
+
+	s.LockFunc(func(l LockedStorer) {
+		if !l.Contains(&X{A: 1}) {
+			t.Errorf("Expected locked store to contain parent")
+		}
+		if n := len(l.Lookup([]string{"b"}, "parent")); n != 1 {
+			t.Errorf("Expected lookup within lock to find parent (got %d)", n)
+		}
+		l.Put(&X{A: 2, B: "child"})
+		l.Delete(&X{A: 1})
+	})
+
+	s.RLockFunc(func(r ReadOnlyStorer) {
+		if _, ok := r.(LockedStorer); ok {
+			t.Errorf("Expected read locked store not to allow writes")
+		}
+		if n := r.Len(); n != 1 {
+			t.Errorf("Expected 1 item within read lock (got %d)", n)
+		}
+		if v := r.Get(&X{A: 2}); v == nil || v.(*X).B != "child" {
+			t.Errorf("Expected to get child within read lock (got %#v)", v)
+		}
+
+		got := ""
+		r.Ascend(func(i interface{}) bool {
+			got += i.(*X).B
+			return true
+		})
+		if got != "child" {
+			t.Errorf("Expected to ascend child within read lock (got %s)", got)
+		}
+	})
+
+	var accessed []int
+	s.SetOnAccess(func(item interface{}) {
+		accessed = append(accessed, item.(*X).A)
+		// Only called once the lock is released, so using the store must not deadlock
+		s.Contains(item)
+	})
+	s.LockFunc(func(l LockedStorer) {
+		l.Get(&X{A: 2})
+		l.Lookup([]string{"b"}, "child")
+		if len(accessed) != 0 {
+			t.Errorf("Expected access hook not to be called while locked")
+		}
+	})
+	if len(accessed) != 2 {
+		t.Errorf("Expected access hook to be called for each read (got %v)", accessed)
+	}
+}
+
+func TestEach(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.CreateIndex("c")
+
+	v1 := &X{A: 1, B: "one:", C: "ZZZ"}
+	v2 := &X{A: 2, B: "two:", C: "ZZZ"}
+	v3 := &X{A: 3, B: "three:", C: "ZZZ"}
+	v4 := &X{A: 4, B: "four:", C: "XXX"}
+	v8 := &X{A: 8, B: "eight:", C: "ZZZ"}
+
+	s.Put(v1)
+	s.Put(v2)
+	s.Put(v3)
+	s.Put(v4)
+	s.Put(v8)
+
+	total := 0
+	s.In("c").Each(func(i interface{}) bool {
+		total += i.(*X).A
+		return true
+	}, "ZZZ")
+
+	if total != 14 {
+		t.Errorf("Expected total of 14 when adding up matching ZZZ items (got %d)", total)
+	}
+}
+
+func upTo(ms int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(ms)*time.Millisecond)
+}
+
+func notificateText(t *testing.T, s Storer, text, what string, expect Indexable) {
+	st := s.(*Store)
+	if expect == nil {
+		if st.index["b"][text] != nil {
+			t.Errorf("Expected b one: index to be nil")
+		}
+	} else if len(st.index["b"][text]) != 1 || st.index["b"][text][0].item != expect {
+		t.Errorf("Expected b %s: index to be %s", text, what)
+	}
+}
+
+func TestNotificates(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	v1 := &X{A: 1, B: "one:"}
+	v2 := &X{A: 1, B: "two:"}
+
+	var expectEvent Event
+	var expectOld, expectNew, expectOne, expectTwo Indexable
+
+	var ctx context.Context
+	var done context.CancelFunc
+
+	h := func(event Event, old, new interface{}, stats Stats) {
+		defer done()
+
+		if event != expectEvent {
+			t.Errorf("Expected event %#v (got %#v)", expectEvent, event)
+		}
+		if old != expectOld {
+			t.Errorf("Expected %#v old value %#v (got %#v)", event, expectOld, old)
+		}
+		if new != expectNew {
+			t.Errorf("Expected %#v new value %#v (got %#v)", event, expectNew, new)
+		}
+
+		notificateText(t, s, "one:", "v1", expectOne)
+		notificateText(t, s, "two:", "v2", expectTwo)
+	}
+
+	s.On(Insert, h)
+	s.On(Update, h)
+	s.On(Remove, h)
+	s.On(Expiry, h)
+
+	ctx, done = upTo(10)
+	expectEvent = Insert
+	expectOld = nil
+	expectNew = v1
+	expectOne = v1
+	expectTwo = nil
+	s.Put(v1)
+	<-ctx.Done()
+
+	ctx, done = upTo(10)
+	expectEvent = Update
+	expectOld = v1
+	expectNew = v2
+	expectOne = nil
+	expectTwo = v2
+	s.Put(v2)
+	<-ctx.Done()
+
+	ctx, done = upTo(10)
+	expectEvent = Remove
+	expectOld = v2
+	expectNew = nil
+	expectOne = nil
+	expectTwo = nil
+	s.Delete(v1) // This is a trick as we asked to delete v1, but v2 is actually getting deleted and should be expected
+	<-ctx.Done()
+
+	ctx, done = upTo(10)
+	expectEvent = Insert
+	expectOld = nil
+	expectNew = v1
+	expectOne = v1
+	expectTwo = nil
+	s.Put(v1)
+	<-ctx.Done()
+
+	ctx, done = upTo(10)
+	expired = 1
+	expectEvent = Expiry
+	expectOld = v1
+	expectNew = nil
+	expectOne = nil
+	expectTwo = nil
+	s.Expire()
+	<-ctx.Done()
+
+	expired = 0
+}
+
+func TestNotifySequence(t *testing.T) {
+	s := NewStore()
+
+	var wg sync.WaitGroup
+	var seqs []uint64
+	h := func(event Event, old, new interface{}, stats Stats) {
+		seqs = append(seqs, stats.Seq)
+		wg.Done()
+	}
+	s.On(Insert, h)
+	s.On(Update, h)
+	s.On(Remove, h)
+
+	wg.Add(4)
+	s.Put(&X{A: 1})
+	s.Put(&X{A: 2})
+	s.Put(&X{A: 1})
+	s.Delete(&X{A: 2})
+	wg.Wait()
+
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Errorf("Expected event %d to have sequence %d (got %d)", i, i+1, seq)
+		}
+	}
+}
+
+func TestAccessNotification(t *testing.T) {
+	s := NewStore()
+	v1 := &X{A: 1}
+	s.Put(v1)
+
+	ctx, done := upTo(10)
+	s.On(Access, func(event Event, old, new interface{}, stats Stats) {
+		defer done()
+		if old != v1 || new != v1 {
+			t.Errorf("Expected access of v1 (got %#v -> %#v)", old, new)
+		}
+		if stats.Reads != 1 {
+			t.Errorf("Expected stats to show 1 read (got %d)", stats.Reads)
+		}
+	})
+
+	s.Get(&X{A: 1})
+	<-ctx.Done()
+}
+
+func TestTrackAccess(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.SetTrackAccess(false)
+
+	var accessed int32
+	s.On(Access, func(event Event, old, new interface{}, stats Stats) {
+		atomic.AddInt32(&accessed, 1)
+	})
+
+	s.Put(&X{A: 1, B: "one"})
+	s.Get(&X{A: 1})
+	s.In("b").One("one")
+	s.Ascend(func(item interface{}) bool { return true })
+
+	s.SetTrackAccess(true)
+	s.Get(&X{A: 1})
+	_, stats, _ := s.GetWithStats(&X{A: 1})
+	s.Close()
+
+	if stats.Reads != 2 {
+		t.Errorf("Expected only tracked reads to be counted (got %d)", stats.Reads)
+	}
+	if stats.Modified.IsZero() {
+		t.Errorf("Expected writes to still be tracked")
+	}
+	if n := atomic.LoadInt32(&accessed); n != 2 {
+		t.Errorf("Expected access events only for tracked reads (got %d)", n)
+	}
+}
+
+func TestReentrantNotify(t *testing.T) {
+	s := NewStore()
+
+	var (
+		mu     sync.Mutex
+		events []string
+		depth  int32
+	)
+	s.On(Insert, func(event Event, old, new interface{}, stats Stats) {
+		if atomic.AddInt32(&depth, 1) > 1 {
+			t.Errorf("Expected handler not to be called recursively")
+		}
+		defer atomic.AddInt32(&depth, -1)
+
+		x := new.(*X)
+		mu.Lock()
+		events = append(events, fmt.Sprintf("insert %d", x.A))
+		mu.Unlock()
+
+		// Derive a record for each original item, but not for derived ones
+		if x.A < 10 {
+			if _, err := s.Put(&X{A: x.A * 10, B: "derived"}); err != nil {
+				t.Errorf("Unexpected error putting from handler: %s", err)
+			}
+			if s.Get(&X{A: x.A}) == nil {
+				t.Errorf("Expected to read the inserted item from handler")
+			}
+		}
+	})
+
+	s.Put(&X{A: 1})
+	s.Put(&X{A: 2})
+
+	// Wait for the derived records to be processed before closing
+	deadline := time.Now().Add(time.Second)
+	for s.Len() < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(events, ","); got != "insert 1,insert 2,insert 10,insert 20" {
+		t.Errorf("Expected derived inserts to follow queued events (got %s)", got)
+	}
+}
+
+func TestParallelNotify(t *testing.T) {
+	s := NewStore().SetParallelNotify(true)
+
+	release := make(chan struct{})
+	removed := make(chan int, 3)
+	s.On(Insert, func(event Event, old, new interface{}, stats Stats) {
+		<-release
+	})
+	s.On(Remove, func(event Event, old, new interface{}, stats Stats) {
+		removed <- old.(*X).A
+	})
+
+	for i := 1; i <= 3; i++ {
+		s.Put(&X{A: i})
+	}
+	s.Delete(&X{A: 2})
+
+	// The Remove handler is not held up by the blocked Insert handler
+	select {
+	case a := <-removed:
+		if a != 2 {
+			t.Errorf("Expected removal of 2 (got %d)", a)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected Remove event while Insert handler is blocked")
+	}
+
+	if n := s.NotifyBacklog(); n < 2 {
+		t.Errorf("Expected at least 2 events in backlog (got %d)", n)
+	}
+
+	close(release)
+	s.Close()
+
+	if n := s.NotifyBacklog(); n != 0 {
+		t.Errorf("Expected empty backlog after close (got %d)", n)
+	}
+}
+
+func TestOnBatch(t *testing.T) {
+	s := NewStore()
+	s.Put(&X{A: 1})
+
+	ctx, done := upTo(10)
+	var got []Change
+	s.OnBatch(func(changes []Change) {
+		defer done()
+		got = changes
+	})
+
+	s.PutAll([]interface{}{
+		&X{A: 1, B: "updated"},
+		&X{A: 2},
+		&X{A: 3},
+	})
+	<-ctx.Done()
+
+	if n := len(got); n != 3 {
+		t.Fatalf("Expected 3 changes in batch (got %d)", n)
+	}
+	if got[0].Event != Update || got[0].Old == nil || got[0].New.(*X).B != "updated" {
+		t.Errorf("Expected first change to be an update (got %#v)", got[0])
+	}
+	if got[1].Event != Insert || got[2].Event != Insert {
+		t.Errorf("Expected remaining changes to be inserts (got %#v)", got[1:])
+	}
+}
+
+func TestExpireBatchSize(t *testing.T) {
+	s := NewStore()
+	s.SetExpirer(LayeredExpirer(nil, func(a interface{}) time.Duration {
+		return time.Nanosecond
+	}, nil))
+	for i := 1; i <= 5; i++ {
+		s.Put(&X{A: i})
+	}
+	time.Sleep(time.Millisecond)
+
+	s.ExpireBatchSize(2)
+	if n := s.Expire(); n != 2 {
+		t.Errorf("Expected first pass to remove 2 items (got %d)", n)
+	}
+	if n := s.Len(); n != 3 {
+		t.Errorf("Expected 3 items to remain (got %d)", n)
+	}
+	if n := s.Due(); n != 3 {
+		t.Errorf("Expected 3 items to remain due (got %d)", n)
+	}
+
+	s.ExpireBatchSize(0)
+	if n := s.Expire(); n != 3 {
+		t.Errorf("Expected uncapped pass to remove remaining 3 items (got %d)", n)
+	}
+	if n := s.Due(); n != 0 {
+		t.Errorf("Expected no items to remain due (got %d)", n)
+	}
+
+	// With tracked deadlines, counting the due items leaves them to be expired
+	s = NewStore()
+	s.SetExpirer(AgeExpirer(0, time.Nanosecond, 0))
+	s.ExpireBatchSize(2)
+	for i := 1; i <= 5; i++ {
+		s.Put(&X{A: i})
+	}
+	time.Sleep(time.Millisecond)
+	s.Expire()
+	if n := s.Due(); n != 3 {
+		t.Errorf("Expected 3 items to remain due with deadlines (got %d)", n)
+	}
+	if n := s.Expire() + s.Expire(); n != 3 {
+		t.Errorf("Expected remaining items to be expired by later passes (got %d)", n)
+	}
+}
+
+func TestExpireN(t *testing.T) {
+	s := NewStore()
+	s.SetExpirer(LayeredExpirer(nil, func(a interface{}) time.Duration {
+		return time.Nanosecond
+	}, nil))
+	for i := 1; i <= 5; i++ {
+		s.Put(&X{A: i})
+	}
+	time.Sleep(time.Millisecond)
+
+	if n := s.ExpireN(3); n != 3 {
+		t.Errorf("Expected 3 items to be removed (got %d)", n)
+	}
+	if n := s.ExpireN(3); n != 2 {
+		t.Errorf("Expected remaining 2 items to be removed (got %d)", n)
+	}
+	if n := s.ExpireN(0); n != 0 {
+		t.Errorf("Expected nothing to be removed with zero max (got %d)", n)
+	}
+}
+
+func TestExpiredChan(t *testing.T) {
+	s := NewStore()
+	s.SetExpirer(LayeredExpirer(nil, func(a interface{}) time.Duration {
+		if a.(*X).A%2 == 0 {
+			return time.Nanosecond
+		}
+		return 0
+	}, nil))
+
+	expired := s.ExpiredChan()
+	if s.ExpiredChan() != expired {
+		t.Errorf("Expected the same channel from each call")
+	}
+
+	for i := 1; i <= 6; i++ {
+		s.Put(&X{A: i})
+	}
+	time.Sleep(time.Millisecond)
+	s.Expire()
+	s.Close()
+
+	got := ""
+	for item := range expired {
+		got += fmt.Sprintf("%d,", item.(*X).A)
+	}
+	if got != "2,4,6," {
+		t.Errorf("Expected even items to be received until close (got %s)", got)
+	}
+}
+
+func TestSetExpirerInUse(t *testing.T) {
+	s := NewStore()
+	s.SetExpirer(AgeExpirer(0, 0, time.Hour))
+	for i := 1; i <= 100; i++ {
+		s.Put(&X{A: i})
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.Expire()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 101; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.Put(&X{A: i})
+		}
+	}()
+
+	// Alternate between an expirer with tracked deadlines and one without
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			s.SetExpirer(LayeredExpirer(nil, func(a interface{}) time.Duration {
+				return time.Hour
+			}, nil))
+		} else {
+			s.SetExpirer(AgeExpirer(0, 0, time.Hour))
+		}
+	}
+	s.SetExpirer(AgeExpirer(0, 0, time.Nanosecond))
+	close(stop)
+	wg.Wait()
+
+	time.Sleep(time.Millisecond)
+	s.Expire()
+	if n := s.Len(); n != 0 {
+		t.Errorf("Expected the final expirer to expire all items (got %d)", n)
+	}
+}
+
+func TestExpireDeadlines(t *testing.T) {
+	s := NewStore()
+	s.SetExpirer(AgeExpirer(0, 0, 200*time.Millisecond))
+	for i := 1; i <= 4; i++ {
+		s.Put(&X{A: i})
+	}
+	s.Put(&X{A: 1, B: "updated"})
+
+	d := s.(*Store).deadlines
+	if d == nil {
+		t.Fatalf("Expected deadlines to be tracked for an age expirer")
+	}
+	if n := len(d.heap); n != 4 {
+		t.Errorf("Expected one deadline per item after updates (got %d)", n)
+	}
+	s.Put(&X{A: 5})
+	s.Delete(&X{A: 5})
+	if n := len(d.heap); n != 4 {
+		t.Errorf("Expected deleted item's deadline to be dropped (got %d)", n)
+	}
+	if n := s.Expire(); n != 0 {
+		t.Errorf("Expected nothing to expire yet (got %d)", n)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	s.Get(&X{A: 2})
+	s.Pin(&X{A: 3})
+	time.Sleep(100 * time.Millisecond)
+
+	if n := s.Expire(); n != 2 {
+		t.Errorf("Expected 2 items to expire (got %d)", n)
+	}
+	if !s.Contains(&X{A: 2}) || !s.Contains(&X{A: 3}) {
+		t.Errorf("Expected accessed and pinned items to remain")
+	}
+	if n := len(d.heap); n != 2 {
+		t.Errorf("Expected only remaining items to be tracked (got %d)", n)
+	}
+
+	s.SetExpirer(LayeredExpirer(nil, nil, AgeExpirer(0, 0, time.Millisecond)))
+	if s.(*Store).deadlines != nil {
+		t.Errorf("Expected deadlines not to be tracked for a custom expirer")
+	}
+}
+
+func TestOnExpiring(t *testing.T) {
+	s := NewStore()
+	old := time.Now().Add(-2 * time.Hour)
+	for i := 1; i <= 3; i++ {
+		s.Put(&X{A: i})
+	}
+	for _, w := range s.(*Store).uids {
+		w.stats.Modified = old
+	}
+	s.SetExpirer(AgeExpirer(0, time.Hour, 0))
+
+	s.OnExpiring(func(item interface{}, stats Stats) bool {
+		return item.(*X).A != 2
+	})
+
+	if n := s.Expire(); n != 2 {
+		t.Errorf("Expected 2 items to be expired (got %d)", n)
+	}
+	if !s.Contains(&X{A: 2}) {
+		t.Errorf("Expected vetoed item to remain")
+	}
+	if n := s.Expire(); n != 0 {
+		t.Errorf("Expected vetoed item to have been refreshed (got %d expired)", n)
+	}
+
+	// Refreshing the modified time doesn't help an access age expirer, the veto holds the item off for an interval
+	s = NewStore()
+	s.ExpireInterval(50 * time.Millisecond)
+	s.SetExpirer(AgeExpirer(0, 0, time.Millisecond))
+	s.Put(&X{A: 1})
+	var calls int64
+	s.OnExpiring(func(item interface{}, stats Stats) bool {
+		return atomic.AddInt64(&calls, 1) > 1
+	})
+	time.Sleep(5 * time.Millisecond)
+
+	if n := s.Expire(); n != 0 || !s.Contains(&X{A: 1}) {
+		t.Errorf("Expected vetoed item to remain (got %d expired)", n)
+	}
+	s.Expire()
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Errorf("Expected vetoed item not to be re-examined within the interval (got %d hook calls)", n)
+	}
+	time.Sleep(70 * time.Millisecond)
+	if n := s.Expire(); n != 1 {
+		t.Errorf("Expected vetoed item to expire once the interval passed (got %d)", n)
+	}
+}
+
+func TestOnExpiringConcurrent(t *testing.T) {
+	s := NewStore()
+	s.SetExpirer(AgeExpirer(0, time.Nanosecond, 0))
+	s.OnExpiring(func(item interface{}, stats Stats) bool {
+		return item.(*X).A%2 == 0
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.Put(&X{A: i % 100})
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		s.Expire()
+	}
+	close(stop)
+	<-done
+	time.Sleep(time.Millisecond)
+	s.Expire()
+
+	s.Ascend(func(item interface{}) bool {
+		if item.(*X).A%2 == 0 {
+			t.Errorf("Expected even items to expire (found %d)", item.(*X).A)
+			return false
+		}
+		return true
+	})
+}
+
+func TestExpireRevalidates(t *testing.T) {
+	s := NewStore()
+	s.SetExpirer(AgeExpirer(0, 0, 0, func(a interface{}, now time.Time, stats Stats) ExpireBool {
+		if a.(*X).B == "old" {
+			return ExpireTrue
+		}
+		return ExpireFalse
+	}))
+	s.Put(&X{A: 1, B: "old"})
+	s.Put(&X{A: 2, B: "old"})
+
+	// The hook is called without the store's lock, replace an item before it is removed
+	s.OnExpiring(func(item interface{}, stats Stats) bool {
+		if item.(*X).A == 1 {
+			s.Put(&X{A: 1, B: "new"})
+		}
+		return true
+	})
+
+	if n := s.Expire(); n != 1 {
+		t.Errorf("Expected only the unreplaced item to be expired (got %d)", n)
+	}
+	if v, ok := s.Get(&X{A: 1}).(*X); !ok || v.B != "new" {
+		t.Errorf("Expected replacement item to remain (got %#v)", v)
+	}
+	if s.Contains(&X{A: 2}) {
+		t.Errorf("Expected item 2 to be expired")
+	}
+}
+
+func TestPin(t *testing.T) {
+	s := NewStore()
+	s.SetExpirer(LayeredExpirer(nil, func(a interface{}) time.Duration {
+		return time.Nanosecond
+	}, nil))
+	s.Put(&X{A: 1})
+	s.Put(&X{A: 2})
+
+	if !s.Pin(&X{A: 1}) {
+		t.Errorf("Expected pin to find item")
+	}
+	if s.Pin(&X{A: 3}) {
+		t.Errorf("Expected pin of missing item to fail")
+	}
+	s.Put(&X{A: 1, B: "updated"})
+	time.Sleep(time.Millisecond)
+
+	if n := s.Expire(); n != 1 {
+		t.Errorf("Expected only unpinned item to expire (got %d)", n)
+	}
+	if _, stats, ok := s.GetWithStats(&X{A: 1}); !ok || !stats.Pinned {
+		t.Errorf("Expected pinned item to remain and report pinned (got %t, %#v)", ok, stats)
+	}
+
+	s.Unpin(&X{A: 1})
+	if n := s.Expire(); n != 1 {
+		t.Errorf("Expected unpinned item to expire (got %d)", n)
+	}
+}
+
+func TestSetOnAccess(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "one"})
+	s.Put(&X{A: 2, B: "two"})
+	s.Put(&X{A: 3, B: "two"})
+
+	var accessed []int
+	s.SetOnAccess(func(item interface{}) {
+		accessed = append(accessed, item.(*X).A)
+		if item.(*X).A == 1 {
+			// Prefetching from within the hook must not deadlock
+			s.Get(&X{A: 2})
+		}
+	})
+
+	s.Get(&X{A: 1})
+	s.In("b").One("one")
+	s.In("b").Lookup("two")
+	s.GetWithStats(&X{A: 3})
+	s.Ascend(func(a interface{}) bool {
+		return true
+	})
+
+	if n := len(accessed); n != 7 {
+		t.Errorf("Expected 7 accesses excluding iteration (got %v)", accessed)
+	}
+}
+
+func TestCapBucket(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b").CapBucket(2, "")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var expiredItem interface{}
+	s.On(Expiry, func(event Event, old, new interface{}, stats Stats) {
+		defer wg.Done()
+		expiredItem = old
+	})
+
+	s.Put(&X{A: 1, B: "user1"})
+	time.Sleep(time.Millisecond)
+	s.Put(&X{A: 2, B: "user1"})
+	time.Sleep(time.Millisecond)
+	s.Put(&X{A: 3, B: "user2"})
+	s.Put(&X{A: 4, B: "user1"})
+
+	if got := len(s.In("b").Lookup("user1")); got != 2 {
+		t.Errorf("Expected user1 bucket to be capped at 2 (got %d)", got)
+	}
+	if s.Contains(&X{A: 1}) || s.Len() != 3 {
+		t.Errorf("Expected only the oldest item to be evicted")
+	}
+	wg.Wait()
+	if x, ok := expiredItem.(*X); !ok || x.A != 1 {
+		t.Errorf("Expected expiry event for item 1 (got %#v)", expiredItem)
+	}
+
+	// The item being put is never evicted, even if it orders lowest
+	s = NewStore()
+	s.CreateIndex("c").CapBucket(1, "b")
+	storage := NewMockStorage()
+	s.Persistent(storage)
+	s.Put(&X{A: 6, B: "user4", C: "x"})
+	res, err := s.PutWithResult(&X{A: 5, B: "user3", C: "x"})
+	if err != nil || res.Action != Inserted {
+		t.Errorf("Expected put item to be inserted (got %#v, %v)", res, err)
+	}
+	if x := s.In("c").One("x"); x == nil || x.(*X).A != 5 {
+		t.Errorf("Expected existing item to be evicted from c (got %#v)", x)
+	}
+	if n := len(storage.Store); n != 1 {
+		t.Errorf("Expected only the stored item to be persisted (got %d)", n)
+	}
+
+	// Pinned items are never evicted, the oldest unpinned items are evicted instead
+	s = NewStore()
+	s.CreateIndex("b").CapBucket(2, "")
+	s.Put(&X{A: 1, B: "sku"})
+	s.Pin(&X{A: 1})
+	time.Sleep(time.Millisecond)
+	s.Put(&X{A: 2, B: "sku"})
+	time.Sleep(time.Millisecond)
+	s.Put(&X{A: 3, B: "sku"})
+	if !s.Contains(&X{A: 1}) || s.Contains(&X{A: 2}) || !s.Contains(&X{A: 3}) {
+		t.Errorf("Expected pinned item to be kept over the cap")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	s := NewStore()
+	s.Put(&X{A: 2, B: "two"})
+	s.Put(&X{A: 1, B: "one"})
+
+	var buf bytes.Buffer
+	if err := s.Export(&buf); err != nil {
+		t.Fatalf("Unexpected error exporting: %s", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Errorf("Expected 2 lines of export (got %d)", lines)
+	}
+
+	r := NewStore()
+	err := r.Import(&buf, func(indexerType string) interface{} {
+		if indexerType != "*memdb.X" {
+			t.Errorf("Unexpected indexerType: %s", indexerType)
+		}
+		return &X{}
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error importing: %s", err)
+	}
+	if x := r.First(); r.Len() != 2 || x.(*X).B != "one" {
+		t.Errorf("Expected imported items to match export (got %d items, first %#v)", r.Len(), x)
+	}
+}
+
+func TestClear(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	storage := NewMockStorage()
+	s.Persistent(storage)
+	s.Put(&X{A: 1, B: "one"})
+	s.Put(&X{A: 2, B: "two"})
+
+	if err := s.Clear(); err != nil {
+		t.Fatalf("Unexpected error clearing store: %s", err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Expected empty store (got %d)", n)
+	}
+	if n := len(storage.Store); n != 0 {
+		t.Errorf("Expected persisted items to be removed (got %d)", n)
+	}
+	if got := s.In("b").Lookup("one"); len(got) != 0 {
+		t.Errorf("Expected empty index (got %#v)", got)
+	}
+
+	s.Put(&X{A: 3, B: "one"})
+	if got := s.In("b").Lookup("one"); len(got) != 1 {
+		t.Errorf("Expected index to work after clear (got %#v)", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+
+	var handled int32
+	s.On(Insert, func(event Event, old, new interface{}, stats Stats) {
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&handled, 1)
+	})
+	s.Put(&X{A: 1})
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error closing store: %s", err)
+	}
+	if atomic.LoadInt32(&handled) != 1 {
+		t.Errorf("Expected pending events to be emitted before close returned")
+	}
+
+	if err := s.Close(); err != ErrClosed {
+		t.Errorf("Expected second close to return ErrClosed (got %v)", err)
+	}
+	if _, err := s.Put(&X{A: 2}); err != ErrClosed {
+		t.Errorf("Expected put to return ErrClosed (got %v)", err)
+	}
+	if n := s.Expire(); n != 0 {
+		t.Errorf("Expected nothing to expire from closed store (got %d)", n)
+	}
+	if _, err := s.Delete(&X{A: 1}); err != ErrClosed {
+		t.Errorf("Expected delete to return ErrClosed (got %v)", err)
+	}
+	if _, _, err := s.GetOrPut(&X{A: 1}, nil); err != ErrClosed {
+		t.Errorf("Expected get or put to return ErrClosed (got %v)", err)
+	}
+	if _, _, err := s.DeleteIf(&X{A: 1}, func(interface{}) bool { return true }); err != ErrClosed {
+		t.Errorf("Expected delete if to return ErrClosed (got %v)", err)
+	}
+	if _, ok := s.GetAndDelete(&X{A: 1}); ok {
+		t.Errorf("Expected get and delete not to claim from a closed store")
+	}
+
+	panics := func(name string, fn func()) {
+		defer func() {
+			if r := recover(); r != "memdb: use of closed store" {
+				t.Errorf("Expected %s on closed store to panic (got %v)", name, r)
+			}
+		}()
+		fn()
+	}
+	panics("get", func() { s.Get(&X{A: 1}) })
+	panics("lookup", func() { s.In("b").Lookup("") })
+	panics("ascend", func() { s.Ascend(func(interface{}) bool { return true }) })
+	if n := s.Len(); n != 1 {
+		t.Errorf("Expected the lock to be released after a panicking read (got %d items)", n)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.CreateIndex("b", "c")
+	s.Put(&X{A: 1, B: "one", C: "x"})
+
+	info, ok := s.Inspect(&X{A: 1})
+	if !ok {
+		t.Fatalf("Expected to inspect stored item")
+	}
+	if uid, _ := s.UID(&X{A: 1}); info.UID != uid {
+		t.Errorf("Expected inspected uid to be %s (got %s)", uid, info.UID)
+	}
+	if info.Item.(*X).B != "one" || info.Stats.Writes != 1 || info.Stats.Reads != 0 {
+		t.Errorf("Unexpected item info (got %#v)", info)
+	}
+	if keys := info.Keys["b\000c"]; len(keys) != 1 || keys[0].String() != "one\000x" {
+		t.Errorf("Expected compound key for item (got %#v)", keys)
+	}
+
+	if _, ok := s.Inspect(&X{A: 2}); ok {
+		t.Errorf("Expected missing item not to be found")
+	}
+}
+
+func TestAscendContext(t *testing.T) {
+	s := NewStore()
+	for i := 0; i < 1000; i++ {
+		s.Put(&X{A: i})
+	}
+
+	n := 0
+	s.AscendContext(context.Background(), func(i interface{}) bool {
+		n++
+		return true
+	})
+	if n != 1000 {
+		t.Errorf("Expected full traversal (got %d)", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n = 0
+	s.DescendContext(ctx, func(i interface{}) bool {
+		n++
+		if n == 150 {
+			cancel()
+		}
+		return true
+	})
+	if n != 200 {
+		t.Errorf("Expected traversal to stop at next check after cancellation (got %d)", n)
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	s := NewStore()
+	if s.First() != nil || s.Last() != nil {
+		t.Errorf("Expected nil first and last for empty store")
+	}
+
+	for _, a := range []int{3, 1, 5, 2} {
+		s.Put(&X{A: a})
+	}
+	if x := s.First(); x == nil || x.(*X).A != 1 {
+		t.Errorf("Expected first item to be 1 (got %#v)", x)
+	}
+	if x := s.Last(); x == nil || x.(*X).A != 5 {
+		t.Errorf("Expected last item to be 5 (got %#v)", x)
+	}
+
+	r := NewStore().Reversed()
+	r.Put(&X{A: 1})
+	r.Put(&X{A: 3})
+	r.Put(&X{A: 2})
+	if x := r.First(); x == nil || x.(*X).A != 3 {
+		t.Errorf("Expected first item of reversed store to be 3 (got %#v)", x)
+	}
+}
+
+func TestIndexReadsCounted(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "one"})
+
+	idx := s.In("b")
+	reads := []func(){
+		func() { s.Get(&X{A: 1}) },
+		func() { idx.Each(func(interface{}) bool { return true }, "one") },
+		func() { idx.One("one") },
+		func() { idx.Lookup("one") },
+		func() { idx.LookupSorted("one") },
+		func() { idx.LookupSortedBy("b", false, "one") },
+		func() { idx.LookupPrefix("o") },
+		func() { idx.LookupPage(0, 1, "one") },
+		func() { idx.All() },
+		func() { idx.Ascend(func(interface{}) bool { return true }) },
+	}
+
+	for i, read := range reads {
+		read()
+		if st := idx.Stats("one"); len(st) != 1 || st[0].Reads != uint64(i+1) {
+			t.Errorf("Expected read %d to be counted in stats (got %#v)", i, st)
+		}
+	}
+}
+
+func TestConcurrentStats(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "one"})
+	s.On(Access, func(event Event, old, new interface{}, stats Stats) {
+		_ = stats.Reads
+	})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s.Get(&X{A: 1})
+				s.In("b").Lookup("one")
+				s.Info(func(uid UID, item interface{}, stats Stats) bool {
+					_ = stats.Reads
+					return true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, stats, _ := s.GetWithStats(&X{A: 1}); stats.Reads != 1201 {
+		t.Errorf("Expected all reads to be counted (got %d)", stats.Reads)
+	}
+}
+
+func TestCompound(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b", "c")
+	v1a := &X{A: 1, B: "one", C: "xxx"}
+	v1b := &X{A: 2, B: "one", C: "zzz"}
+	v2a := &X{A: 3, B: "two", C: "xxx"}
+	v2b := &X{A: 4, B: "two", C: "zzz"}
+
+	s.Put(v1a)
+	s.Put(v1b)
+	s.Put(v2a)
+	s.Put(v2b)
+
+	out := s.In("b", "c").Lookup("one", "zzz")
+	if n := len(out); n != 1 {
+		t.Errorf("Expected exactly one response from compound lookup (got %d)", n)
+	}
+	if out[0].(*X).A != 2 {
+		t.Errorf("Expected a = 2 in compound result (got %#v)", out[0])
+	}
+}
+
+func TestLookupSorted(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 3, B: "ford"})
+	s.Put(&X{A: 1, B: "ford"})
+	s.Put(&X{A: 4, B: "holden"})
+	s.Put(&X{A: 2, B: "ford"})
+
+	got := ""
+	for _, item := range s.In("b").LookupSorted("ford") {
+		got += fmt.Sprintf("%d", item.(*X).A)
+	}
+	if got != "123" {
+		t.Errorf("Expected sorted lookup to return 123 (got %s)", got)
+	}
+
+	if out := s.In("b").LookupSorted("kia"); out != nil {
+		t.Errorf("Expected nil sorted lookup for missing key (got %#v)", out)
+	}
+}
+
+type sale struct {
+	ID    string
+	Make  string
+	Sales int
+}
+
+func TestGetByKey(t *testing.T) {
+	s := NewStore().PrimaryKey("make", "id")
+	s.Put(&sale{ID: "rio", Make: "kia", Sales: 3})
+	s.Put(&sale{ID: "focus", Make: "ford", Sales: 5})
+	s.Put(&sale{ID: "ranger", Make: "ford", Sales: 7})
+
+	if v, ok := s.GetByKey("ford", "ranger").(*sale); !ok || v.Sales != 7 {
+		t.Errorf("Expected to get item by primary key (got %#v)", v)
+	}
+	if v := s.GetByKey("ford", "rio"); v != nil {
+		t.Errorf("Expected no item for missing key (got %#v)", v)
+	}
+	if v := s.GetByKey("ford"); v != nil {
+		t.Errorf("Expected no item for partial key (got %#v)", v)
+	}
+	if _, stats, _ := s.GetWithStats(&sale{ID: "rio", Make: "kia"}); stats.Reads != 1 {
+		t.Errorf("Expected only GetWithStats to read the item (got %d)", stats.Reads)
+	}
+	s.GetByKey("kia", "rio")
+	if _, stats, _ := s.GetWithStats(&sale{ID: "rio", Make: "kia"}); stats.Reads != 3 {
+		t.Errorf("Expected GetByKey to count as a read (got %d)", stats.Reads)
+	}
+
+	if v := NewStore().GetByKey("x"); v != nil {
+		t.Errorf("Expected no item without a primary key (got %#v)", v)
+	}
+}
+
+func TestAscendFrom(t *testing.T) {
+	s := NewStore().PrimaryKey("make", "id")
+	for _, v := range []*sale{
+		{ID: "rio", Make: "kia"},
+		{ID: "focus", Make: "ford"},
+		{ID: "ranger", Make: "ford"},
+		{ID: "astra", Make: "holden"},
+		{ID: "colorado", Make: "holden"},
+	} {
+		s.Put(v)
+	}
+
+	page := func(items []interface{}) string {
+		ids := make([]string, len(items))
+		for i, item := range items {
+			ids[i] = item.(*sale).ID
+		}
+		return strings.Join(ids, ",")
+	}
+
+	items, cursor := s.AscendFrom("", 2)
+	if got := page(items); got != "focus,ranger" || cursor == "" {
+		t.Errorf("Expected first page (got %s, cursor %q)", got, cursor)
+	}
+
+	// The boundary item is not repeated, even if it has been deleted in between
+	s.Delete(&sale{ID: "ranger", Make: "ford"})
+	items, cursor = s.AscendFrom(cursor, 2)
+	if got := page(items); got != "astra,colorado" || cursor == "" {
+		t.Errorf("Expected second page (got %s, cursor %q)", got, cursor)
+	}
+	if cursor != Cursor(FieldKey{"holden", "colorado"}.String()) {
+		t.Errorf("Expected cursor to be the last item's primary key (got %q)", cursor)
+	}
+
+	items, cursor = s.AscendFrom(cursor, 2)
+	if got := page(items); got != "rio" || cursor != "" {
+		t.Errorf("Expected final page with an empty cursor (got %s, cursor %q)", got, cursor)
+	}
+
+	if items, cursor = s.AscendFrom("", 0); len(items) != 4 || cursor != "" {
+		t.Errorf("Expected all items without a limit (got %d, cursor %q)", len(items), cursor)
+	}
+}
+
+func TestIndexAscendDescend(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "ford"})
+	s.Put(&X{A: 2, B: "audi"})
+	s.Put(&X{A: 3, B: "ford"})
+	s.Put(&X{A: 4, B: "bmw"})
+
+	got := ""
+	iter := func(i interface{}) bool {
+		got += fmt.Sprintf("%d", i.(*X).A)
+		return true
+	}
+
+	s.In("b").Ascend(iter)
+	if got != "2413" {
+		t.Errorf("Expected ascending index order 2413 (got %s)", got)
+	}
+
+	got = ""
+	s.In("b").Descend(iter)
+	if got != "1342" {
+		t.Errorf("Expected descending index order 1342 (got %s)", got)
+	}
+
+	got = ""
+	s.In("b").Ascend(func(i interface{}) bool {
+		got += fmt.Sprintf("%d", i.(*X).A)
+		return len(got) < 2
+	})
+	if got != "24" {
+		t.Errorf("Expected iteration to stop early (got %s)", got)
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.CreateIndex("c")
+	storage := NewMockStorage()
+	s.Persistent(storage)
+	s.Put(&X{A: 1, B: "ford", C: "x"})
+	s.Put(&X{A: 2, B: "audi", C: "x"})
+	s.Put(&X{A: 3, B: "ford", C: "y"})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	s.On(Remove, func(event Event, old, new interface{}, stats Stats) {
+		wg.Done()
+	})
+
+	n, err := s.In("b").DeleteAll("ford")
+	if n != 2 || err != nil {
+		t.Errorf("Expected 2 items deleted without error (got %d, %v)", n, err)
+	}
+	wg.Wait()
+
+	if s.Len() != 1 || len(storage.Store) != 1 {
+		t.Errorf("Expected one item to remain in store and persister (got %d and %d)", s.Len(), len(storage.Store))
+	}
+	if got := s.In("c").Lookup("y"); len(got) != 0 {
+		t.Errorf("Expected deleted items to be removed from other indexes (got %#v)", got)
+	}
+	if n, _ := s.In("b").DeleteAll("ford"); n != 0 {
+		t.Errorf("Expected nothing left to delete (got %d)", n)
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "ford"})
+	s.Put(&X{A: 2, B: "audi"})
+	s.Put(&X{A: 3, B: "ford"})
+	s.Put(&X{A: 4, B: "bmw"})
+
+	got := ""
+	s.In("b").Distinct(func(key string, sample interface{}) bool {
+		got += fmt.Sprintf("%s=%d,", key, sample.(*X).A)
+		return true
+	})
+	if got != "audi=2,bmw=4,ford=1," {
+		t.Errorf("Expected one sample per distinct key (got %s)", got)
+	}
+
+	s = NewStore().Reversed()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "ford"})
+	s.Put(&X{A: 2, B: "audi"})
+	s.Put(&X{A: 4, B: "bmw"})
+
+	got = ""
+	s.In("b").Distinct(func(key string, sample interface{}) bool {
+		got += key + ","
+		return true
+	})
+	if got != "ford,bmw,audi," {
+		t.Errorf("Expected keys in descending order for a reversed store (got %s)", got)
+	}
+}
+
+func TestLookupPage(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	for _, a := range []int{5, 3, 1, 4, 2} {
+		s.Put(&X{A: a, B: "page"})
+	}
+
+	page := func(offset, limit int) string {
+		got := ""
+		for _, item := range s.In("b").LookupPage(offset, limit, "page") {
+			got += fmt.Sprintf("%d", item.(*X).A)
+		}
+		return got
+	}
+
+	if got := page(0, 2); got != "12" {
+		t.Errorf("Expected first page 12 (got %s)", got)
+	}
+	if got := page(2, 2); got != "34" {
+		t.Errorf("Expected second page 34 (got %s)", got)
+	}
+	if got := page(4, 2); got != "5" {
+		t.Errorf("Expected clamped last page 5 (got %s)", got)
+	}
+	if got := page(1, int(^uint(0)>>1)); got != "2345" {
+		t.Errorf("Expected the rest of the items for the largest limit (got %s)", got)
+	}
+	if got := s.In("b").LookupPage(10, 2, "page"); got == nil || len(got) != 0 {
+		t.Errorf("Expected empty slice past end (got %#v)", got)
+	}
+}
+
+func TestLookupSortedBy(t *testing.T) {
+	s := NewStore()
+	s.PrimaryKey("id")
+	s.CreateIndex("make")
+	s.Put(&sale{"a", "ford", 900})
+	s.Put(&sale{"b", "ford", 10000})
+	s.Put(&sale{"c", "ford", 80})
+	s.Put(&sale{"d", "holden", 50})
+
+	got := ""
+	for _, item := range s.In("make").LookupSortedBy("sales", true, "ford") {
+		got += item.(*sale).ID
+	}
+	if got != "bac" {
+		t.Errorf("Expected numeric descending order bac (got %s)", got)
+	}
+
+	got = ""
+	for _, item := range s.In("make").LookupSortedBy("sales", false, "ford") {
+		got += item.(*sale).ID
+	}
+	if got != "cab" {
+		t.Errorf("Expected numeric ascending order cab (got %s)", got)
+	}
+}
+
+func TestLookupPrefix(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	s.CreateIndex("b", "c")
+	s.Put(&X{A: 1, B: "C38/11/A", C: "xxx"})
+	s.Put(&X{A: 2, B: "C38/11/B", C: "zzz"})
+	s.Put(&X{A: 3, B: "C38/12/A", C: "xxx"})
+	s.Put(&X{A: 4, B: "D10/11/A", C: "zzz"})
+
+	if n := len(s.In("b").LookupPrefix("C38/11/")); n != 2 {
+		t.Errorf("Expected 2 items with prefix C38/11/ (got %d)", n)
+	}
+
+	got := ""
+	for _, item := range s.In("b").LookupPrefix("C38/") {
+		got += item.(*X).B + ","
+	}
+	if got != "C38/11/A,C38/11/B,C38/12/A," {
+		t.Errorf("Expected 3 items with prefix C38/ in key order (got %s)", got)
+	}
+
+	out := s.In("b", "c").LookupPrefix("C38/12/A\000")
+	if n := len(out); n != 1 || out[0].(*X).A != 3 {
+		t.Errorf("Expected exactly item 3 from compound prefix lookup (got %#v)", out)
+	}
+
+	if out = s.In("b").LookupPrefix("E"); out != nil {
+		t.Errorf("Expected no items for unmatched prefix (got %#v)", out)
+	}
+}
+
+func TestLookupMulti(t *testing.T) {
+	s := NewStore()
+	s.SetFielder(tagFielder{})
+	s.PrimaryKey("id")
+	s.CreateIndex("tags")
+	s.CreateIndex("id", "tags")
+
+	s.Put(&tagged{"a", []string{"red", "fast"}})
+	s.Put(&tagged{"b", []string{"blue"}})
+	s.Put(&tagged{"c", []string{"green"}})
+
+	if n := len(s.In("tags").LookupMulti("red", "fast", "blue", "pink")); n != 2 {
+		t.Errorf("Expected 2 distinct items for red, fast or blue (got %d)", n)
+	}
+	if out := s.In("tags").LookupMulti(); out != nil {
+		t.Errorf("Expected no items for no keys (got %#v)", out)
+	}
+
+	out := s.In("id", "tags").LookupAny([][]string{{"a", "fast"}, {"c", "green"}, {"c"}})
+	if n := len(out); n != 2 {
+		t.Errorf("Expected 2 items from compound keys (got %d)", n)
+	}
+}
+
+func TestExcept(t *testing.T) {
+	s := NewStore()
+	s.SetFielder(tagFielder{})
+	s.PrimaryKey("id")
+	s.CreateIndex("tags")
+
+	s.Put(&tagged{"a", []string{"red", "fast"}})
+	s.Put(&tagged{"b", []string{"blue", "fast"}})
+	s.Put(&tagged{"c", []string{"green"}})
+	s.Put(&tagged{"d", []string{"blue"}})
+
+	out := s.In("tags").Except("red")
+	if n := len(out); n != 3 {
+		t.Errorf("Expected 3 items not tagged red (got %d)", n)
+	}
+	for _, item := range out {
+		if item.(*tagged).ID == "a" {
+			t.Errorf("Expected item tagged red and fast to be excluded")
+		}
+	}
+
+	if n := len(s.In("tags").Except("fast", "green")); n != 1 {
+		t.Errorf("Expected 1 item not tagged fast or green (got %d)", n)
+	}
+	if n := len(s.In("tags").Except()); n != 4 {
+		t.Errorf("Expected every item once with no exclusions (got %d)", n)
+	}
+}
+
+func TestLookupOrdered(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b").Ordered()
+
+	for _, a := range []int{5, 1, 4, 2, 3} {
+		s.Put(&X{A: a, B: "user"})
+	}
+	s.Delete(&X{A: 5})
+	s.Delete(&X{A: 4})
+	s.Put(&X{A: 1, B: "user", C: "updated"})
+
+	got := ""
+	for _, item := range s.In("b").LookupOrdered("user") {
+		got += fmt.Sprintf("%d", item.(*X).A)
+	}
+	if got != "231" {
+		t.Errorf("Expected items in put order 231 (got %s)", got)
+	}
+}
+
+func TestSetKeySeparator(t *testing.T) {
+	s := NewStore().SetKeySeparator("|")
+	s.CreateIndex("b", "c")
+	s.Put(&X{A: 1, B: "a\000", C: "b"})
+	s.Put(&X{A: 2, B: "a", C: "\000b"})
+
+	if n := len(s.In("b", "c").Lookup("a\000", "b")); n != 1 {
+		t.Errorf("Expected components containing NUL not to collide (got %d)", n)
+	}
+	if keys := s.KeysSorted("b", "c"); len(keys) != 2 || keys[0] != "a\000|b" {
+		t.Errorf("Expected keys joined by separator (got %q)", keys)
+	}
+	if out := s.In("b", "c").LookupPrefix("a|"); len(out) != 1 || out[0].(*X).A != 2 {
+		t.Errorf("Expected prefix lookup with separator (got %#v)", out)
+	}
+
+	stats := s.IndexStats("b", "c")
+	if len(stats) != 2 || len(stats[0].Key) != 2 {
+		t.Errorf("Expected index stats keys to be split by separator (got %#v)", stats)
+	}
+}
+
+func TestFieldKeyRoundTrip(t *testing.T) {
+	for _, keys := range [][]string{
+		{"one"},
+		{"one", "x"},
+		{"a\000b", "c"},
+		{"\001", "\000\001", ""},
+		{"", ""},
+	} {
+		fk := FieldKey(keys)
+		got := NewFieldKey(fk.String()).Keys()
+		if !reflect.DeepEqual(got, keys) {
+			t.Errorf("Expected %q to round trip (got %q)", keys, got)
+		}
+	}
+
+	if s := (FieldKey{"one", "x"}).String(); s != "one\000x" {
+		t.Errorf("Expected plain keys to be joined by NUL (got %q)", s)
+	}
+}
+
+func TestConfigureConcurrent(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("b")
+	idx := s.In("b")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.SetFielder(tagFielder{})
+			s.SetLogger(func(level, msg string, kv ...interface{}) {})
+			s.On(Insert, func(event Event, old, new interface{}, stats Stats) {})
+			s.OnBatch(func(changes []Change) {})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			idx.FieldKey(&X{A: i, B: "b"})
+			s.Put(&X{A: i, B: "b"})
+			s.PutAll([]interface{}{&X{A: i + 100}})
+		}
+	}()
+	wg.Wait()
+	s.Close()
+
+	if key := idx.FieldKey(&X{A: 1, B: "b"}); key.String() != "b" {
+		t.Errorf("Expected field key from current fielder (got %q)", key.String())
+	}
+}
+
+type config struct {
+	Name   string
+	Config struct {
+		Region string
+		Sizes  []int
+	}
+}
+
+func TestCreateIndexByJSON(t *testing.T) {
+	s := NewStore()
+	s.PrimaryKey("name")
+	s.CreateIndexByJSON("cfg", "config")
+	s.CreateIndexByJSON("missing", "config.missing")
+
+	a := &config{Name: "a"}
+	a.Config.Region = "au"
+	a.Config.Sizes = []int{1, 2}
+	b := &config{Name: "b"}
+	b.Config.Region = "au"
+	b.Config.Sizes = []int{1, 2}
+	c := &config{Name: "c"}
+	c.Config.Region = "us"
+
+	s.Put(a)
+	s.Put(b)
+	s.Put(c)
+
+	key := s.In("cfg").FieldKey(a)
+	if j := key.String(); j != `{"Region":"au","Sizes":[1,2]}` {
+		t.Errorf("Unexpected JSON index key (got %s)", j)
+	}
+
+	if n := len(s.In("cfg").Lookup(key.Keys()...)); n != 2 {
+		t.Errorf("Expected 2 items with identical config (got %d)", n)
+	}
+
+	if keys := s.Keys("missing"); len(keys) != 1 || keys[0] != "" {
+		t.Errorf("Expected items without a value at the path to have an empty key (got %q)", keys)
+	}
+}
+
+func TestNumeric(t *testing.T) {
+	s := NewStore()
+	s.CreateComputedIndex("a", func(item interface{}) string {
+		return fmt.Sprintf("%d", item.(*X).A)
+	}).Numeric()
+	for _, a := range []int{9, 1000, -5, 0, 42, -100} {
+		s.Put(&X{A: a})
+	}
+
+	got := ""
+	s.IndexRange([]string{"a"}, []string{"-50"}, []string{"100"}, func(i interface{}) bool {
+		got += fmt.Sprintf("%d,", i.(*X).A)
+		return true
+	})
+	if got != "-5,0,9,42," {
+		t.Errorf("Expected numeric range order -5,0,9,42, (got %s)", got)
+	}
+
+	if x := s.In("a").One("1000"); x == nil || x.(*X).A != 1000 {
+		t.Errorf("Expected lookup by plain number (got %#v)", x)
+	}
+	if numericKey("-1.5") >= numericKey("-1") || numericKey("2.5") >= numericKey("10") {
+		t.Errorf("Expected numeric keys to order numerically")
+	}
+}
+
+func TestNilItems(t *testing.T) {
+	s := NewStore()
+	var typed *X
+
+	if _, err := s.Put(nil); err != ErrNil {
+		t.Errorf("Expected ErrNil putting nil (got %v)", err)
+	}
+	if _, err := s.Put(typed); err != ErrNil {
+		t.Errorf("Expected ErrNil putting typed nil (got %v)", err)
+	}
+	if err := s.PutAll([]interface{}{&X{A: 1}, nil, typed, &X{A: 2}}); err != nil {
+		t.Errorf("Expected nil items to be skipped without error (got %v)", err)
+	}
+	if n := s.Len(); n != 2 {
+		t.Errorf("Expected 2 items stored (got %d)", n)
+	}
+	if v := s.Get(typed); v != nil {
+		t.Errorf("Expected no item for typed nil (got %#v)", v)
+	}
+	if _, err := s.Delete(typed); err != ErrNil {
+		t.Errorf("Expected ErrNil deleting typed nil (got %v)", err)
 	}
 }
 
-func upTo(ms int) (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), time.Duration(ms)*time.Millisecond)
-}
+func TestBetween(t *testing.T) {
+	s := NewStore().PrimaryKey("id")
+	s.CreateIndex("sales").Numeric()
+	for i, sales := range []int{900, 25, 7000, 150, 150, 3} {
+		s.Put(&sale{ID: fmt.Sprintf("%c", 'a'+i), Make: "ford", Sales: sales})
+	}
 
-func notificateText(t *testing.T, s Storer, text, what string, expect Indexable) {
-	st := s.(*Store)
-	if expect == nil {
-		if st.index["b"][text] != nil {
-			t.Errorf("Expected b one: index to be nil")
-		}
-	} else if len(st.index["b"][text]) != 1 || st.index["b"][text][0].item != expect {
-		t.Errorf("Expected b %s: index to be %s", text, what)
+	got := ""
+	for _, item := range s.In("sales").Between("10", "1000") {
+		got += fmt.Sprintf("%d,", item.(*sale).Sales)
+	}
+	if got != "25,150,150,900," {
+		t.Errorf("Expected sales between 10 and 1000 in numeric order (got %s)", got)
+	}
+
+	if items := s.In("sales").Between("8000", "9000"); len(items) != 0 {
+		t.Errorf("Expected no items in an empty range (got %d)", len(items))
+	}
+	if items := s.In("missing").Between("0", "1"); items != nil {
+		t.Errorf("Expected nil for a missing index (got %#v)", items)
 	}
 }
 
-func TestNotificates(t *testing.T) {
+func TestCreateComputedIndex(t *testing.T) {
 	s := NewStore()
-	s.CreateIndex("b")
-	v1 := &X{A: 1, B: "one:"}
-	v2 := &X{A: 1, B: "two:"}
+	s.PrimaryKey("id")
+	s.CreateIndex("make")
+	s.CreateComputedIndex("band", func(item interface{}) string {
+		return fmt.Sprintf("%d", item.(*sale).Sales/1000)
+	})
 
-	var expectEvent Event
-	var expectOld, expectNew, expectOne, expectTwo Indexable
+	s.Put(&sale{"a", "ford", 900})
+	s.Put(&sale{"b", "ford", 1500})
+	s.Put(&sale{"c", "holden", 1999})
 
-	var ctx context.Context
-	var done context.CancelFunc
+	if n := len(s.In("band").Lookup("1")); n != 2 {
+		t.Errorf("Expected 2 items in computed band 1 (got %d)", n)
+	}
+	if n := len(s.In("make").Lookup("ford")); n != 2 {
+		t.Errorf("Expected 2 items in field index alongside computed index (got %d)", n)
+	}
 
-	h := func(event Event, old, new interface{}, stats Stats) {
-		defer done()
+	indexes := s.Indexes()
+	if len(indexes) != 3 || indexes[2][0] != "band" {
+		t.Errorf("Expected computed index to be listed in indexes (got %#v)", indexes)
+	}
+}
 
-		if event != expectEvent {
-			t.Errorf("Expected event %#v (got %#v)", expectEvent, event)
-		}
-		if old != expectOld {
-			t.Errorf("Expected %#v old value %#v (got %#v)", event, expectOld, old)
-		}
-		if new != expectNew {
-			t.Errorf("Expected %#v new value %#v (got %#v)", event, expectNew, new)
-		}
+type tagged struct {
+	ID   string
+	Tags []string
+}
 
-		notificateText(t, s, "one:", "v1", expectOne)
-		notificateText(t, s, "two:", "v2", expectTwo)
-	}
+type tagFielder struct{}
 
-	s.On(Insert, h)
-	s.On(Update, h)
-	s.On(Remove, h)
-	s.On(Expiry, h)
+func (tagFielder) GetField(a interface{}, field string) string {
+	return reflective(a, strings.Split(field, "."))
+}
 
-	ctx, done = upTo(10)
-	expectEvent = Insert
-	expectOld = nil
-	expectNew = v1
-	expectOne = v1
-	expectTwo = nil
-	s.Put(v1)
-	<-ctx.Done()
+func (f tagFielder) GetFields(a interface{}, field string) []string {
+	if field == "tags" {
+		return a.(*tagged).Tags
+	}
+	return []string{f.GetField(a, field)}
+}
 
-	ctx, done = upTo(10)
-	expectEvent = Update
-	expectOld = v1
-	expectNew = v2
-	expectOne = nil
-	expectTwo = v2
-	s.Put(v2)
-	<-ctx.Done()
+func TestMultiFielder(t *testing.T) {
+	s := NewStore()
+	s.SetFielder(tagFielder{})
+	s.PrimaryKey("id")
+	s.CreateIndex("tags")
+	s.CreateIndex("id", "tags")
 
-	ctx, done = upTo(10)
-	expectEvent = Remove
-	expectOld = v2
-	expectNew = nil
-	expectOne = nil
-	expectTwo = nil
-	s.Delete(v1) // This is a trick as we asked to delete v1, but v2 is actually getting deleted and should be expected
-	<-ctx.Done()
+	s.Put(&tagged{"a", []string{"red", "fast"}})
+	s.Put(&tagged{"b", []string{"red", "red", "slow"}})
+	s.Put(&tagged{"c", []string{"blue"}})
 
-	ctx, done = upTo(10)
-	expectEvent = Insert
-	expectOld = nil
-	expectNew = v1
-	expectOne = v1
-	expectTwo = nil
-	s.Put(v1)
-	<-ctx.Done()
+	if n := len(s.In("tags").Lookup("red")); n != 2 {
+		t.Errorf("Expected 2 items tagged red (got %d)", n)
+	}
+	if n := len(s.In("tags").Lookup("fast")); n != 1 {
+		t.Errorf("Expected 1 item tagged fast (got %d)", n)
+	}
+	if n := len(s.In("id", "tags").Lookup("b", "slow")); n != 1 {
+		t.Errorf("Expected 1 item for compound multi-value key (got %d)", n)
+	}
+	if n := len(s.In("tags").LookupPrefix("")); n != 3 {
+		t.Errorf("Expected prefix lookup to return each item once (got %d)", n)
+	}
 
-	ctx, done = upTo(10)
-	expired = 1
-	expectEvent = Expiry
-	expectOld = v1
-	expectNew = nil
-	expectOne = nil
-	expectTwo = nil
-	s.Expire()
-	<-ctx.Done()
+	s.Put(&tagged{"a", []string{"blue"}})
+	if n := len(s.In("tags").Lookup("red")); n != 1 {
+		t.Errorf("Expected 1 item tagged red after retagging (got %d)", n)
+	}
+	if vals := s.In("tags").Lookup("fast"); vals != nil {
+		t.Errorf("Expected no items tagged fast after retagging (got %#v)", vals)
+	}
 
-	expired = 0
+	s.Delete(&tagged{ID: "b"})
+	if n := len(s.In("tags").Lookup("blue")); n != 2 {
+		t.Errorf("Expected 2 items tagged blue (got %d)", n)
+	}
+	if vals := s.In("tags").Lookup("slow"); vals != nil {
+		t.Errorf("Expected no items tagged slow after delete (got %#v)", vals)
+	}
 }
 
-func TestCompound(t *testing.T) {
+func TestWhere(t *testing.T) {
 	s := NewStore()
-	s.CreateIndex("b", "c")
-	v1a := &X{A: 1, B: "one", C: "xxx"}
-	v1b := &X{A: 2, B: "one", C: "zzz"}
-	v2a := &X{A: 3, B: "two", C: "xxx"}
-	v2b := &X{A: 4, B: "two", C: "zzz"}
+	s.PrimaryKey("id")
+	s.CreateIndex("make").Where(func(item interface{}) bool {
+		return item.(*sale).Sales > 0
+	})
+	s.CreateIndex("sales")
 
-	s.Put(v1a)
-	s.Put(v1b)
-	s.Put(v2a)
-	s.Put(v2b)
+	s.Put(&sale{"a", "ford", 10})
+	s.Put(&sale{"b", "ford", 0})
+	s.Put(&sale{"c", "holden", 0})
 
-	out := s.In("b", "c").Lookup("one", "zzz")
-	if n := len(out); n != 1 {
-		t.Errorf("Expected exactly one response from compound lookup (got %d)", n)
+	if n := len(s.In("make").Lookup("ford")); n != 1 {
+		t.Errorf("Expected 1 item in partial index (got %d)", n)
 	}
-	if out[0].(*X).A != 2 {
-		t.Errorf("Expected a = 2 in compound result (got %#v)", out[0])
+	if vals := s.In("make").Lookup("holden"); vals != nil {
+		t.Errorf("Expected no items in partial index for holden (got %#v)", vals)
+	}
+	if n := len(s.In("sales").Lookup("0")); n != 2 {
+		t.Errorf("Expected excluded items to remain in other indexes (got %d)", n)
+	}
+
+	s.Put(&sale{"a", "ford", 0})
+	s.Put(&sale{"c", "holden", 5})
+	if vals := s.In("make").Lookup("ford"); vals != nil {
+		t.Errorf("Expected item to leave partial index when no longer matching (got %#v)", vals)
+	}
+	if n := len(s.In("make").Lookup("holden")); n != 1 {
+		t.Errorf("Expected item to join partial index when matching (got %d)", n)
+	}
+	if n := s.Len(); n != 3 {
+		t.Errorf("Expected 3 items in store (got %d)", n)
 	}
 }
 
@@ -619,6 +3219,166 @@ func TestUnique(t *testing.T) {
 	}
 }
 
+func TestLayeredExpirer(t *testing.T) {
+	now := time.Now()
+	stats := Stats{
+		Created:  now.Add(-2 * time.Hour),
+		Modified: now.Add(-2 * time.Hour),
+		Accessed: now.Add(-2 * time.Hour),
+	}
+
+	e := LayeredExpirer(
+		func(a interface{}) bool {
+			return a.(*X).B == "pinned"
+		},
+		func(a interface{}) time.Duration {
+			if a.(*X).B == "long" {
+				return 3 * time.Hour
+			}
+			return 0
+		},
+		AgeExpirer(0, 0, time.Hour),
+	)
+
+	if e.IsExpired(&X{B: "pinned"}, now, stats) {
+		t.Errorf("Expected pinned item not to expire")
+	}
+	if e.IsExpired(&X{B: "long"}, now, stats) {
+		t.Errorf("Expected item with long TTL not to expire")
+	}
+	if !e.IsExpired(&X{B: "long"}, now.Add(2*time.Hour), stats) {
+		t.Errorf("Expected item with long TTL to expire after TTL")
+	}
+	if !e.IsExpired(&X{B: "idle"}, now, stats) {
+		t.Errorf("Expected idle item to expire via global expirer")
+	}
+}
+
+func TestAgeExpirerFuncOrder(t *testing.T) {
+	now := time.Now()
+	old := Stats{Created: now.Add(-2 * time.Hour)}
+	young := Stats{Created: now}
+
+	var calls []string
+	f := func(name string, v ExpireBool) ExpireFunc {
+		return func(a interface{}, now time.Time, stats Stats) ExpireBool {
+			calls = append(calls, name)
+			return v
+		}
+	}
+
+	e := AgeExpirer(time.Hour, 0, 0, f("null", ExpireNull), f("false", ExpireFalse), f("true", ExpireTrue))
+	if e.IsExpired(&X{}, now, old) {
+		t.Errorf("Expected first deciding ExpireFunc to keep old item")
+	}
+	if len(calls) != 2 {
+		t.Errorf("Expected ExpireFuncs to be called in order until one decides (got %v)", calls)
+	}
+
+	calls = nil
+	all := AgeExpirerRequireAll(time.Hour, 0, 0, f("true", ExpireTrue), f("null", ExpireNull))
+	if all.IsExpired(&X{}, now, young) {
+		t.Errorf("Expected ExpireTrue not to override unexpired age when all are required")
+	}
+	if !all.IsExpired(&X{}, now, old) {
+		t.Errorf("Expected old item to expire when all checks agree")
+	}
+	if len(calls) != 4 {
+		t.Errorf("Expected each ExpireFunc to be called once per check (got %v)", calls)
+	}
+
+	calls = nil
+	all = AgeExpirerRequireAll(time.Hour, 0, 0, f("false", ExpireFalse), f("true", ExpireTrue))
+	if all.IsExpired(&X{}, now, old) || len(calls) != 1 {
+		t.Errorf("Expected ExpireFalse to keep the item without further checks (got %v)", calls)
+	}
+}
+
+func TestScoreExpirer(t *testing.T) {
+	now := time.Now()
+	e := ScoreExpirer(1, func(a interface{}, now time.Time, stats Stats) float64 {
+		idle := now.Sub(stats.Accessed).Hours() + 1
+		return float64(stats.Reads) / idle
+	})
+
+	if !e.IsExpired(&X{}, now, Stats{Accessed: now, Reads: 0}) {
+		t.Errorf("Expected unread item to expire")
+	}
+	if e.IsExpired(&X{}, now, Stats{Accessed: now, Reads: 5}) {
+		t.Errorf("Expected recently read item not to expire")
+	}
+	if !e.IsExpired(&X{}, now, Stats{Accessed: now.Add(-10 * time.Hour), Reads: 5}) {
+		t.Errorf("Expected long idle item to expire")
+	}
+}
+
+func TestExpiryReason(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("c").CapBucket(1, "")
+	s.SetExpirer(LayeredExpirer(
+		nil,
+		func(a interface{}) time.Duration {
+			if a.(*X).B == "ttl" {
+				return time.Nanosecond
+			}
+			return 0
+		},
+		AgeExpirer(0, 0, 0, func(a interface{}, now time.Time, stats Stats) ExpireBool {
+			if a.(*X).B == "age" {
+				return ExpireTrue
+			}
+			return ExpireFalse
+		}),
+	))
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		reasons = map[int]ExpiryReason{}
+	)
+	wg.Add(3)
+	s.On(Expiry, func(event Event, old, new interface{}, stats Stats) {
+		defer wg.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[old.(*X).A] = stats.Reason
+	})
+
+	s.Put(&X{A: 1, B: "ttl", C: "one"})
+	s.Put(&X{A: 2, B: "age", C: "two"})
+	s.Put(&X{A: 3, B: "keep", C: "capped"})
+	time.Sleep(time.Millisecond)
+	s.Put(&X{A: 4, B: "keep", C: "capped"})
+	s.Expire()
+	wg.Wait()
+
+	if reasons[1] != TTLExpired || reasons[2] != AgeExpired || reasons[3] != Evicted {
+		t.Errorf("Expected TTL, age and eviction reasons (got %v)", reasons)
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expected only the newest capped item to remain (got %d)", s.Len())
+	}
+}
+
+func TestAssertIndexed(t *testing.T) {
+	defer func(d bool) {
+		debug = d
+		if r := recover(); r == nil {
+			t.Errorf("The code did not panic")
+		}
+	}(debug)
+	debug = true
+
+	s := NewStore()
+	s.CreateIndex("b")
+	s.Put(&X{A: 1, B: "one"})
+
+	st := s.(*Store)
+	w := st.index["b"]["one"][0]
+	st.index["b"]["one"] = nil
+	st.assertIndexed(w, true)
+}
+
 func TestUnsure(t *testing.T) {
 	if !Unsure("A", "Z") {
 		t.Errorf("Expected A to be < Z")
@@ -652,12 +3412,42 @@ func TestEventString(t *testing.T) {
 		t.Errorf("Expiry string incorrect")
 	}
 
+	if Access.String() != "Access event" {
+		t.Errorf("Access string incorrect")
+	}
+
 	bad := Event(-1)
 	if bad.String() != "Unknown event" {
 		t.Errorf("Event unknown string incorrect")
 	}
 }
 
+type plainStorage struct {
+	s *Storage
+}
+
+func (p *plainStorage) Save(id string, indexer interface{}) error { return p.s.Save(id, indexer) }
+func (p *plainStorage) Load(loadFunc persist.LoadFunc) error      { return p.s.Load(loadFunc) }
+func (p *plainStorage) Remove(id string) error                    { return p.s.Remove(id) }
+
+func TestPersisterAccessors(t *testing.T) {
+	s := NewStore()
+	if s.IsPersistent() || s.PersisterKind() != "" || s.MetaEnabled() {
+		t.Errorf("Expected new store not to be persistent")
+	}
+
+	s.Persistent(NewMockStorage())
+	if !s.IsPersistent() || s.PersisterKind() != "*memdb.Storage" || !s.MetaEnabled() {
+		t.Errorf("Expected store to report meta persister (got %q)", s.PersisterKind())
+	}
+
+	p := NewStore()
+	p.Persistent(&plainStorage{NewMockStorage()})
+	if !p.IsPersistent() || p.PersisterKind() != "*memdb.plainStorage" || p.MetaEnabled() {
+		t.Errorf("Expected store to report plain persister (got %q)", p.PersisterKind())
+	}
+}
+
 func TestPersistentAfterUse(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -697,6 +3487,152 @@ func TestPrimaryKey(t *testing.T) {
 	}
 }
 
+type byValue struct{}
+
+func (byValue) Less(a, b interface{}) bool {
+	return a.(*anon).Value < b.(*anon).Value
+}
+
+func TestSetComparatorReindex(t *testing.T) {
+	s := NewStore()
+	s.PrimaryKey("id")
+
+	s.Put(&anon{"a", 40})
+	s.Put(&anon{"b", 10})
+	s.Put(&anon{"c", 30})
+	s.Put(&anon{"d", 20})
+
+	s.SetComparatorReindex(byValue{})
+
+	order := ""
+	s.Ascend(func(i interface{}) bool {
+		order += i.(*anon).ID
+		return true
+	})
+
+	if order != "bdca" {
+		t.Errorf("Wrong order of items after reindex, expected bdca (got %s)", order)
+	}
+
+	if v := s.Get(&anon{Value: 30}); v == nil || v.(*anon).ID != "c" {
+		t.Errorf("Expected to get c by value after reindex (got %#v)", v)
+	}
+
+	// Collapsed items are forgotten entirely
+	s = NewStore().PrimaryKey("id").StrictKeys(true)
+	s.SetExpirer(AgeExpirer(0, 0, time.Hour))
+	a := &anon{"a", 10}
+	b := &anon{"b", 10}
+	s.Put(a)
+	s.Put(b)
+	s.SetComparatorReindex(byValue{})
+	if s.Len() != 1 || len(s.(*Store).deadlines.heap) != 1 {
+		t.Errorf("Expected a single item and deadline after collapse (got %d)", s.Len())
+	}
+	a.Value = 20
+	if _, err := s.Put(a); err != nil {
+		t.Errorf("Unexpected error putting collapsed item again: %v", err)
+	}
+}
+
+func TestStrictKeys(t *testing.T) {
+	s := NewStore()
+	s.PrimaryKey("id")
+	s.StrictKeys(true)
+
+	a := &anon{"a", 10}
+	s.Put(a)
+	s.Put(&anon{"b", 20})
+
+	a.Value = 15
+	if _, err := s.Put(a); err != nil {
+		t.Errorf("Unexpected error re-putting item with unchanged key: %v", err)
+	}
+
+	a.ID = "c"
+	if _, err := s.Put(a); err == nil {
+		t.Errorf("Expected error re-putting item with changed key")
+	}
+	if n := s.Len(); n != 2 {
+		t.Errorf("Expected store to be unchanged with 2 items (got %d)", n)
+	}
+
+	a.ID = "a"
+	s.Delete(a)
+	a.ID = "c"
+	if _, err := s.Put(a); err != nil {
+		t.Errorf("Unexpected error putting item after delete: %v", err)
+	}
+}
+
+func TestStrictFields(t *testing.T) {
+	s := NewStore().StrictFields(true)
+	s.CreateIndex("id")
+	s.CreateIndex("model")
+
+	if _, err := s.Put(&anon{"a", 10}); err == nil || !strings.Contains(err.Error(), `"model"`) {
+		t.Errorf("Expected error naming unresolved field (got %v)", err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Expected item not to be stored (got %d)", n)
+	}
+
+	s = NewStore().StrictFields(true)
+	s.CreateIndex("id")
+	if _, err := s.Put(&anon{"a", 10}); err != nil {
+		t.Errorf("Unexpected error for resolvable field: %s", err)
+	}
+	if err := s.PutAll([]interface{}{&anon{"", 20}}); err == nil {
+		t.Errorf("Expected PutAll to report unresolved field")
+	}
+}
+
+func TestSetDegree(t *testing.T) {
+	s := NewStore().SetDegree(32)
+	s.CreateIndex("b")
+	for i := 0; i < 1000; i++ {
+		s.Put(&X{A: i, B: fmt.Sprintf("%d", i%10)})
+	}
+
+	if n := s.Len(); n != 1000 {
+		t.Errorf("Expected 1000 items (got %d)", n)
+	}
+	if x := s.Last(); x == nil || x.(*X).A != 999 {
+		t.Errorf("Expected last item to be 999 (got %#v)", x)
+	}
+	if n := len(s.In("b").Lookup("3")); n != 100 {
+		t.Errorf("Expected 100 items in bucket (got %d)", n)
+	}
+}
+
+func BenchmarkDegree(b *testing.B) {
+	for _, degree := range []int{2, 32, 64} {
+		b.Run(fmt.Sprintf("degree-%d", degree), func(b *testing.B) {
+			s := NewStore().SetDegree(degree)
+			for i := 0; i < 100000; i++ {
+				s.Put(&X{A: i})
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Get(&X{A: i % 100000})
+			}
+		})
+	}
+}
+
+func TestSetFloatFormat(t *testing.T) {
+	s := NewStore()
+	s.CreateIndex("float64")
+	s.SetFloatFormat('g', -1)
+	s.Put(&R{Str: "a", Float64: 5000.0000001})
+	s.Put(&R{Str: "b", Float64: 5000})
+
+	if n := len(s.In("float64").Lookup("5000")); n != 1 {
+		t.Errorf("Expected 1 item with key 5000 (got %d)", n)
+	}
+}
+
 func TestReversed(t *testing.T) {
 	s := NewStore()
 	s.PrimaryKey("id")
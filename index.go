@@ -1,6 +1,12 @@
 package memdb
 
 import (
+	"github.com/google/btree"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,14 +20,59 @@ type Index struct {
 	fields []string
 	store  *Store
 	unique bool
+
+	compute func(a interface{}) string
+	where   func(a interface{}) bool
+	keys    *btree.BTree
+
+	capN    int
+	capBy   string
+	numeric bool
+	ordered bool
+
+	onConflict ConflictFunc
+}
+
+// indexKey is a key within an index, stored in an index's ordered set of keys
+type indexKey string
+
+func (k indexKey) Less(than btree.Item) bool {
+	return k < than.(indexKey)
 }
 
 // FieldKey represents the key for an item within a field
 type FieldKey []string
 
+// fieldKeySep separates the keys of a FieldKey's representation string, fieldKeyEscape precedes either character where
+// it appears within a key
+const (
+	fieldKeySep    = '\000'
+	fieldKeyEscape = '\001'
+)
+
 // NewFieldKey returns a FieldKey from a field representation string [ FieldKey.String() ]
 func NewFieldKey(from string) FieldKey {
-	return FieldKey(strings.Split(from, "\000"))
+	var (
+		fk      FieldKey
+		key     []byte
+		escaped bool
+	)
+	for i := 0; i < len(from); i++ {
+		c := from[i]
+		switch {
+		case escaped:
+			key = append(key, c)
+			escaped = false
+		case c == fieldKeyEscape:
+			escaped = true
+		case c == fieldKeySep:
+			fk = append(fk, string(key))
+			key = key[:0]
+		default:
+			key = append(key, c)
+		}
+	}
+	return append(fk, string(key))
 }
 
 // Keys are the keys contained in the FieldKey
@@ -31,12 +82,33 @@ func (fk FieldKey) Keys() []string {
 }
 
 // String returns a representation string for the FieldKey [ can supply to NewFieldKey() ]
+// Keys are joined by "\000", any "\000" or "\001" within the keys is escaped by a preceding "\001" so that the
+// representation can be losslessly converted back.
 func (fk FieldKey) String() string {
-	return strings.Join(fk.Keys(), "\000")
+	var b strings.Builder
+	for i, key := range fk {
+		if i > 0 {
+			b.WriteByte(fieldKeySep)
+		}
+		for j := 0; j < len(key); j++ {
+			if c := key[j]; c == fieldKeySep || c == fieldKeyEscape {
+				b.WriteByte(fieldKeyEscape)
+			}
+			b.WriteByte(key[j])
+		}
+	}
+	return b.String()
 }
 
 // FieldKey returns the used key value for the given item for this index
 func (idx *Index) FieldKey(a interface{}) FieldKey {
+	idx.store.RLock()
+	defer idx.store.RUnlock()
+
+	if idx.compute != nil {
+		return FieldKey{idx.compute(a)}
+	}
+
 	components := make([]string, len(idx.fields))
 	for i, field := range idx.fields {
 		components[i] = idx.store.GetField(a, field)
@@ -51,7 +123,7 @@ func (idx *Index) Each(cb Iterator, keys ...string) {
 		return
 	}
 
-	idx.store.RLock()
+	idx.store.rlockOpen()
 	defer idx.store.RUnlock()
 
 	values := idx.find(keys)
@@ -61,13 +133,7 @@ func (idx *Index) Each(cb Iterator, keys ...string) {
 
 	now := time.Now()
 	for _, wrapped := range values {
-		wrapped.stats.read(now)
-		idx.store.happens <- &happening{
-			event: Access,
-			old:   wrapped.item,
-			new:   wrapped.item,
-			stats: wrapped.stats,
-		}
+		idx.store.access(wrapped, now)
 
 		if !cb(wrapped.item) {
 			return
@@ -75,29 +141,102 @@ func (idx *Index) Each(cb Iterator, keys ...string) {
 	}
 }
 
+// Ascend calls iterator for the items in each of the index's keys, in ascending key order, until the end or the
+// iterator returns false
+// Items within a key are in the order they were added to the index. An item held under multiple keys (via a
+// MultiFielder) is visited once for each key.
+func (idx *Index) Ascend(cb Iterator) {
+	if idx == nil {
+		return
+	}
+
+	idx.store.rlockOpen()
+	defer idx.store.RUnlock()
+
+	idx.keys.Ascend(idx.keyIterator(cb))
+}
+
+// Descend calls iterator for the items in each of the index's keys, in descending key order, until the end or the
+// iterator returns false
+// Items within a key are in the order they were added to the index.
+func (idx *Index) Descend(cb Iterator) {
+	if idx == nil {
+		return
+	}
+
+	idx.store.rlockOpen()
+	defer idx.store.RUnlock()
+
+	idx.keys.Descend(idx.keyIterator(cb))
+}
+
+func (idx *Index) keyIterator(cb Iterator) btree.ItemIterator {
+	now := time.Now()
+	indexWraps := idx.store.index[idx.id]
+	return func(item btree.Item) bool {
+		for _, wrapped := range indexWraps[string(item.(indexKey))] {
+			idx.store.access(wrapped, now)
+
+			if !cb(wrapped.item) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Distinct calls cb once for each key in the index, in ascending key order (or descending if the store is reversed),
+// with the key and the first item held under it, until the end or cb returns false
+// For compound indexes the key's components are joined by the store's key separator (see SetKeySeparator).
+func (idx *Index) Distinct(cb func(key string, sample interface{}) bool) {
+	if idx == nil {
+		return
+	}
+
+	idx.store.rlockOpen()
+	defer idx.store.RUnlock()
+
+	now := time.Now()
+	indexWraps := idx.store.index[idx.id]
+	walk := idx.keys.Ascend
+	if idx.store.reversed {
+		walk = idx.keys.Descend
+	}
+	walk(func(item btree.Item) bool {
+		key := string(item.(indexKey))
+		wraps := indexWraps[key]
+		if len(wraps) == 0 {
+			return true
+		}
+
+		wrapped := wraps[0]
+		idx.store.access(wrapped, now)
+		return cb(key, wrapped.item)
+	})
+}
+
 // One is like Lookup, except just returns the first item found
 func (idx *Index) One(keys ...string) interface{} {
 	if idx == nil {
 		return nil
 	}
 
-	idx.store.RLock()
-	defer idx.store.RUnlock()
-
+	idx.store.rlockOpen()
+	var item interface{}
 	now := time.Now()
 	values := idx.find(keys)
 	if len(values) > 0 {
 		wrapped := values[0]
-		wrapped.stats.read(now)
-		idx.store.happens <- &happening{
-			event: Access,
-			old:   wrapped.item,
-			new:   wrapped.item,
-			stats: wrapped.stats,
-		}
-		return wrapped.item
+		idx.store.access(wrapped, now)
+		item = wrapped.item
 	}
-	return nil
+	onAccess := idx.store.onAccess
+	idx.store.RUnlock()
+
+	if onAccess != nil && item != nil {
+		onAccess(item)
+	}
+	return item
 }
 
 // Lookup returns the list of items from the index that match given key
@@ -107,9 +246,20 @@ func (idx *Index) Lookup(keys ...string) []interface{} {
 		return nil
 	}
 
-	idx.store.RLock()
-	defer idx.store.RUnlock()
+	idx.store.rlockOpen()
+	items := idx.lookup(keys)
+	onAccess := idx.store.onAccess
+	idx.store.RUnlock()
 
+	if onAccess != nil {
+		for _, item := range items {
+			onAccess(item)
+		}
+	}
+	return items
+}
+
+func (idx *Index) lookup(keys []string) []interface{} {
 	values := idx.find(keys)
 	if values == nil {
 		return nil
@@ -119,18 +269,326 @@ func (idx *Index) Lookup(keys ...string) []interface{} {
 	c := make([]interface{}, len(values))
 	for i, wrapped := range values {
 		c[i] = wrapped.item
-		wrapped.stats.read(now)
-		idx.store.happens <- &happening{
-			event: Access,
-			old:   wrapped.item,
-			new:   wrapped.item,
-			stats: wrapped.stats,
+		idx.store.access(wrapped, now)
+	}
+	return c
+}
+
+// LookupAny returns the list of items from the index that match any of the given keys, each of which is a full key for
+// the index (as would be passed to Lookup)
+// Items matching more than one of the keys are only returned once. Returned items are not guaranteed to be in any
+// particular order.
+func (idx *Index) LookupAny(keys [][]string) []interface{} {
+	if idx == nil {
+		return nil
+	}
+
+	idx.store.rlockOpen()
+	now := time.Now()
+	seen := map[*wrap]bool{}
+	var items []interface{}
+	for _, key := range keys {
+		for _, wrapped := range idx.find(key) {
+			if seen[wrapped] {
+				continue
+			}
+			seen[wrapped] = true
+
+			items = append(items, wrapped.item)
+			idx.store.access(wrapped, now)
+		}
+	}
+	onAccess := idx.store.onAccess
+	idx.store.RUnlock()
+
+	if onAccess != nil {
+		for _, item := range items {
+			onAccess(item)
+		}
+	}
+	return items
+}
+
+// LookupMulti returns the list of items from a single field index that match any of the given keys
+// Unlike Lookup, where the keys are the components of a single compound key, each key is looked up separately, as for
+// LookupAny.
+func (idx *Index) LookupMulti(keys ...string) []interface{} {
+	anyKeys := make([][]string, len(keys))
+	for i, key := range keys {
+		anyKeys[i] = []string{key}
+	}
+	return idx.LookupAny(anyKeys)
+}
+
+// Except returns the list of items from a single field index that do not match any of the given keys
+// Items held under one of the keys are excluded even if they are also held under other keys, and each item is only
+// returned once. Returned items are not guaranteed to be in any particular order.
+func (idx *Index) Except(keys ...string) []interface{} {
+	if idx == nil {
+		return nil
+	}
+
+	idx.store.rlockOpen()
+	defer idx.store.RUnlock()
+
+	index, ok := idx.store.index[idx.id]
+	if !ok {
+		return nil
+	}
+
+	excluded := map[string]bool{}
+	seen := map[*wrap]bool{}
+	for _, key := range keys {
+		key = idx.key([]string{key})
+		excluded[key] = true
+		for _, wrapped := range index[key] {
+			seen[wrapped] = true
+		}
+	}
+
+	now := time.Now()
+	var c []interface{}
+	for key, values := range index {
+		if excluded[key] {
+			continue
+		}
+
+		for _, wrapped := range values {
+			if seen[wrapped] {
+				continue
+			}
+			seen[wrapped] = true
+
+			c = append(c, wrapped.item)
+			idx.store.access(wrapped, now)
 		}
 	}
 	return c
 }
 
-// Stats returns the stats for all items in the index without modifying access time
+// LookupOrdered returns the list of items from the index that match given key, in the order they were put
+// The order is only kept for indexes created with Ordered, for other indexes this is the same as Lookup.
+func (idx *Index) LookupOrdered(keys ...string) []interface{} {
+	return idx.Lookup(keys...)
+}
+
+// LookupSorted returns the list of items from the index that match given key, sorted by the store's comparator
+// (honoring a reversed store)
+func (idx *Index) LookupSorted(keys ...string) []interface{} {
+	if idx == nil {
+		return nil
+	}
+
+	idx.store.rlockOpen()
+	defer idx.store.RUnlock()
+
+	values := idx.find(keys)
+	if values == nil {
+		return nil
+	}
+
+	sorted := make([]*wrap, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool {
+		return idx.store.Less(sorted[i].item, sorted[j].item)
+	})
+
+	now := time.Now()
+	c := make([]interface{}, len(sorted))
+	for i, wrapped := range sorted {
+		c[i] = wrapped.item
+		idx.store.access(wrapped, now)
+	}
+	return c
+}
+
+// LookupPage returns a window of up to limit items, starting at offset, from the items in the index that match given
+// key, sorted by the store's comparator (as per LookupSorted) so that pages are stable
+// An empty slice is returned if offset is past the end of the matched items.
+func (idx *Index) LookupPage(offset, limit int, keys ...string) []interface{} {
+	if idx == nil {
+		return []interface{}{}
+	}
+
+	idx.store.rlockOpen()
+	defer idx.store.RUnlock()
+
+	values := idx.find(keys)
+	if offset < 0 {
+		offset = 0
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	if offset >= len(values) {
+		return []interface{}{}
+	}
+	if limit > len(values)-offset {
+		limit = len(values) - offset
+	}
+
+	sorted := make([]*wrap, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool {
+		return idx.store.Less(sorted[i].item, sorted[j].item)
+	})
+
+	now := time.Now()
+	c := make([]interface{}, limit)
+	for i, wrapped := range sorted[offset : offset+limit] {
+		c[i] = wrapped.item
+		idx.store.access(wrapped, now)
+	}
+	return c
+}
+
+// LookupSortedBy returns the list of items from the index that match given key, sorted by the value of field by
+// Values which are both numeric are compared numerically, otherwise they are compared as strings. Set desc to sort in
+// descending order.
+func (idx *Index) LookupSortedBy(by string, desc bool, keys ...string) []interface{} {
+	if idx == nil {
+		return nil
+	}
+
+	idx.store.rlockOpen()
+	defer idx.store.RUnlock()
+
+	values := idx.find(keys)
+	if values == nil {
+		return nil
+	}
+
+	type sortable struct {
+		wrapped *wrap
+		value   string
+	}
+
+	sorted := make([]sortable, len(values))
+	for i, wrapped := range values {
+		sorted[i] = sortable{
+			wrapped: wrapped,
+			value:   idx.store.GetField(wrapped.item, by),
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if desc {
+			return lessNumeric(sorted[j].value, sorted[i].value)
+		}
+		return lessNumeric(sorted[i].value, sorted[j].value)
+	})
+
+	now := time.Now()
+	c := make([]interface{}, len(sorted))
+	for i, s := range sorted {
+		wrapped := s.wrapped
+		c[i] = wrapped.item
+		idx.store.access(wrapped, now)
+	}
+	return c
+}
+
+// LookupPrefix returns the list of items from the index whose key starts with the given prefix
+// For compound indexes the prefix is matched against the joined key, so (with the default key separator) a prefix of
+// "one\000" would match all items whose first component is "one".
+// The matching keys are found by a range scan of the index's ordered keys, so the cost depends on the number of
+// matching keys rather than the size of the index. Items are returned in ascending key order, items sharing the same key
+// are not guaranteed to be in any particular order.
+// Prefixes match the keys as strings, so are meaningless for Numeric indexes, where "1" would match keys 1, 10 and 100.
+func (idx *Index) LookupPrefix(prefix string) []interface{} {
+	if idx == nil {
+		return nil
+	}
+
+	idx.store.rlockOpen()
+	defer idx.store.RUnlock()
+
+	index, ok := idx.store.index[idx.id]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	seen := map[*wrap]bool{}
+	var c []interface{}
+	idx.keys.AscendGreaterOrEqual(indexKey(prefix), func(item btree.Item) bool {
+		key := string(item.(indexKey))
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+
+		for _, wrapped := range index[key] {
+			if seen[wrapped] {
+				continue
+			}
+			seen[wrapped] = true
+
+			c = append(c, wrapped.item)
+			idx.store.access(wrapped, now)
+		}
+		return true
+	})
+	return c
+}
+
+// Between returns the items from the index whose key is between low and high (inclusive), in ascending key order
+// The keys are compared as strings unless the index is Numeric, in which case numeric values are compared numerically.
+// It is intended for single field indexes, use the store's IndexRange to range over compound keys.
+// Items sharing the same key are not guaranteed to be in any particular order.
+func (idx *Index) Between(low, high string) []interface{} {
+	if idx == nil {
+		return nil
+	}
+
+	var c []interface{}
+	idx.store.IndexRange(idx.fields, []string{low}, []string{high}, func(item interface{}) bool {
+		c = append(c, item)
+		return true
+	})
+	return c
+}
+
+// DeleteAll removes every item held under the given key in the index from the store, emitting a Remove event for each,
+// and returns the number of items removed
+// The items are removed under a single lock. If the persister fails to remove any of the items they are still removed
+// from the store, and an error reporting the number of failures is returned.
+func (idx *Index) DeleteAll(keys ...string) (int, error) {
+	if idx == nil {
+		return 0, nil
+	}
+
+	s := idx.store
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	values := idx.find(keys)
+	wraps := make([]*wrap, len(values))
+	copy(wraps, values)
+
+	removed, errs := 0, 0
+	for _, wrapped := range wraps {
+		old, err := s.rm(wrapped)
+		if err != nil {
+			errs++
+		}
+		if old != nil {
+			removed++
+			s.notify(Remove, old.item, nil, old.stats.copy())
+		}
+	}
+	s.checkSize()
+
+	if errs > 0 {
+		return removed, fmt.Errorf("%d errors occurred during operation", errs)
+	}
+	return removed, nil
+}
+
+// Stats returns the stats for all items in the index that match given key without modifying access time
+// The returned stats are copies, in the same order as Lookup would return the items.
 func (idx *Index) Stats(keys ...string) []Stats {
 	if idx == nil {
 		return nil
@@ -144,7 +602,7 @@ func (idx *Index) Stats(keys ...string) []Stats {
 	if n > 0 {
 		c := make([]Stats, n)
 		for i, wrapped := range values {
-			c[i] = wrapped.stats
+			c[i] = wrapped.stats.copy()
 		}
 		return c
 	}
@@ -157,18 +615,19 @@ func (idx *Index) All() []interface{} {
 		return nil
 	}
 
-	idx.store.RLock()
+	idx.store.rlockOpen()
 	defer idx.store.RUnlock()
 
-	done := map[string]bool{}
+	now := time.Now()
+	done := map[*wrap]bool{}
 	items := []interface{}{}
 	if index, ok := idx.store.index[idx.id]; ok {
-		for _, idx := range index {
-			for _, wrap := range idx {
-				uid := wrap.uid.String()
-				if d, ok := done[uid]; !ok || !d {
-					items = append(items, wrap.item)
-					done[uid] = true
+		for _, wraps := range index {
+			for _, wrapped := range wraps {
+				if !done[wrapped] {
+					items = append(items, wrapped.item)
+					done[wrapped] = true
+					idx.store.access(wrapped, now)
 				}
 			}
 		}
@@ -201,7 +660,7 @@ func (idx *Index) find(keys []string) []*wrap {
 		return nil
 	}
 
-	key := strings.Join(keys, "\000")
+	key := idx.key(keys)
 
 	values, ok := index[key]
 	if !ok {
@@ -210,3 +669,57 @@ func (idx *Index) find(keys []string) []*wrap {
 
 	return values
 }
+
+// older returns whether wrap a is ordered before wrap b by the index's CapBucket ordering
+func (idx *Index) older(a, b *wrap) bool {
+	switch idx.capBy {
+	case "", "Created":
+		return a.stats.copy().Created.Before(b.stats.copy().Created)
+	case "Modified":
+		return a.stats.copy().Modified.Before(b.stats.copy().Modified)
+	case "Accessed":
+		return a.stats.copy().Accessed.Before(b.stats.copy().Accessed)
+	}
+	return lessNumeric(idx.store.GetField(a.item, idx.capBy), idx.store.GetField(b.item, idx.capBy))
+}
+
+// key returns the key within the index for the given key components
+func (idx *Index) key(components []string) string {
+	if idx.numeric {
+		encoded := make([]string, len(components))
+		for i, component := range components {
+			encoded[i] = numericKey(component)
+		}
+		components = encoded
+	}
+	return idx.store.joinKey(components)
+}
+
+// numericKey encodes a numeric value as 16 hex digits whose lexical order matches numeric order, values which are
+// not numeric are returned unchanged
+// The value is encoded as the bits of a float64, with the sign bit flipped for positive values and all bits flipped for
+// negative values, so negatives order before positives. Integers beyond +/-2^53 lose precision.
+func numericKey(value string) string {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return fmt.Sprintf("%016x", bits)
+}
+
+// lessNumeric compares a and b numerically if they are both numbers, otherwise as strings
+func lessNumeric(a, b string) bool {
+	af, aErr := strconv.ParseFloat(a, 64)
+	bf, bErr := strconv.ParseFloat(b, 64)
+	if aErr == nil && bErr == nil {
+		return af < bf
+	}
+	return a < b
+}
@@ -28,6 +28,7 @@ type Comparator interface {
 
 // ExpireFunc is a function that is run to determine if an item is expired
 //   return ExpireNull to take no expire action and allow any other Expirers to act
+// Both AgeExpirer and AgeExpirerRequireAll run their ExpireFuncs in order before checking the item's times.
 type ExpireFunc func(a interface{}, now time.Time, stats Stats) ExpireBool
 
 // Expirer can determine if an item is expired given a current time, last Accessed
@@ -36,11 +37,27 @@ type Expirer interface {
 	IsExpired(a interface{}, now time.Time, stats Stats) bool
 }
 
+// ExpiryReasoner is an Expirer which can report why an item it has found to be expired is expiring
+// The reason is delivered in the Stats of the item's Expiry event, Expirers which are not ExpiryReasoners are reported
+// as AgeExpired.
+type ExpiryReasoner interface {
+	Expirer
+	ExpiryReason(a interface{}, now time.Time, stats Stats) ExpiryReason
+}
+
 // Fielder can get the string value for a given item's named field
 type Fielder interface {
 	GetField(a interface{}, field string) string
 }
 
+// MultiFielder is a Fielder which can return multiple values for a given item's named field
+// When the store's Fielder is a MultiFielder, items are indexed under each of the values returned, so that a lookup on
+// any one of them will find the item.
+type MultiFielder interface {
+	Fielder
+	GetFields(a interface{}, field string) []string
+}
+
 var (
 	none = &wrap{}
 )
@@ -3,9 +3,22 @@ package memdb
 // IndexSearcher can return results from an index
 type IndexSearcher interface {
 	Each(cb Iterator, keys ...string)
+	Ascend(cb Iterator)
+	Descend(cb Iterator)
+	Distinct(cb func(key string, sample interface{}) bool)
 	One(keys ...string) interface{}
 	Lookup(keys ...string) []interface{}
+	LookupAny(keys [][]string) []interface{}
+	LookupMulti(keys ...string) []interface{}
+	Except(keys ...string) []interface{}
+	LookupSorted(keys ...string) []interface{}
+	LookupOrdered(keys ...string) []interface{}
+	LookupPage(offset, limit int, keys ...string) []interface{}
+	LookupSortedBy(by string, desc bool, keys ...string) []interface{}
+	LookupPrefix(prefix string) []interface{}
+	Between(low, high string) []interface{}
 	All() []interface{}
+	DeleteAll(keys ...string) (int, error)
 	FieldKey(a interface{}) FieldKey
 	Stats(keys ...string) []Stats
 	_id() string
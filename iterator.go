@@ -1,8 +1,25 @@
 package memdb
 
+import "context"
+
 // Iterator is a callback function definition that processes each item iteratively from functions like
 // Ascend, Descend etc
 type Iterator func(i interface{}) bool
 
 // InfoIterator is a callback function definition that processes each item iteratively from Info function
 type InfoIterator func(uid UID, i interface{}, stat Stats) bool
+
+// contextCheckInterval is how many items a context aware traversal visits between checks for cancellation
+const contextCheckInterval = 100
+
+// contextIterator wraps cb to stop the traversal once ctx is done, checking every contextCheckInterval items
+func contextIterator(ctx context.Context, cb Iterator) Iterator {
+	n := 0
+	return func(i interface{}) bool {
+		if n%contextCheckInterval == 0 && ctx.Err() != nil {
+			return false
+		}
+		n++
+		return cb(i)
+	}
+}
@@ -0,0 +1,67 @@
+package memdb
+
+import "time"
+
+// PinFunc is a function that returns whether an item is pinned and should never expire
+type PinFunc func(a interface{}) bool
+
+// TTLFunc is a function that returns an explicit time to live for an item since it was last modified
+// Returning 0 indicates the item has no explicit TTL and should fall through to the global policy.
+type TTLFunc func(a interface{}) time.Duration
+
+type layeredExpirer struct {
+	pinned PinFunc
+	ttl    TTLFunc
+	global Expirer
+}
+
+// LayeredExpirer is an Expirer that combines pinning, per-item TTLs and a global policy (such as an AgeExpirer)
+// The layers are consulted in order, the first layer to make a decision wins:
+//   - if pinned returns true, the item never expires
+//   - if ttl returns a non-zero duration, the item expires once it has not been modified for that duration
+//   - otherwise the global Expirer decides
+//
+// Any of the layers may be nil to skip them.
+func LayeredExpirer(pinned PinFunc, ttl TTLFunc, global Expirer) Expirer {
+	return &layeredExpirer{
+		pinned: pinned,
+		ttl:    ttl,
+		global: global,
+	}
+}
+
+// IsExpired implements the necessary function for an Expirer
+func (le *layeredExpirer) IsExpired(a interface{}, now time.Time, stats Stats) bool {
+	return le.ExpiryReason(a, now, stats) != NotExpired
+}
+
+// ExpiryReason implements the necessary function for an ExpiryReasoner, items expired by the ttl layer are reported as
+// TTLExpired, and by the global layer as it reports them
+func (le *layeredExpirer) ExpiryReason(a interface{}, now time.Time, stats Stats) ExpiryReason {
+	if le.pinned != nil && le.pinned(a) {
+		return NotExpired
+	}
+
+	if le.ttl != nil {
+		if ttl := le.ttl(a); ttl != 0 {
+			mTime := stats.Modified
+			if mTime.IsZero() {
+				mTime = stats.Created
+			}
+			if now.Sub(mTime) > ttl {
+				return TTLExpired
+			}
+			return NotExpired
+		}
+	}
+
+	if le.global == nil || !le.global.IsExpired(a, now, stats) {
+		return NotExpired
+	}
+	if reasoner, ok := le.global.(ExpiryReasoner); ok {
+		if reason := reasoner.ExpiryReason(a, now, stats); reason != NotExpired {
+			return reason
+		}
+	}
+	return AgeExpired
+}
@@ -0,0 +1,148 @@
+package memdb
+
+import "strings"
+
+// ReadOnlyStorer provides read access to a store while its lock is held by RLockFunc or LockFunc
+type ReadOnlyStorer interface {
+	Get(search interface{}) interface{}
+	Contains(search interface{}) bool
+	Lookup(fields []string, keys ...string) []interface{}
+	Len() int
+
+	Ascend(cb Iterator)
+	AscendStarting(at interface{}, cb Iterator)
+	Descend(cb Iterator)
+	DescendStarting(at interface{}, cb Iterator)
+}
+
+// LockedStorer provides read and write access to a store while its lock is held by LockFunc
+type LockedStorer interface {
+	ReadOnlyStorer
+
+	Put(item interface{}) (interface{}, error)
+	Delete(search interface{}) (interface{}, error)
+}
+
+// readOnlyStore implements ReadOnlyStorer, performing reads on the store without acquiring its lock
+// Items read are collected in accessed, so the OnAccess hook (which may itself use the store) can be called for them
+// once the lock is released.
+type readOnlyStore struct {
+	s        *Store
+	accessed []interface{}
+}
+
+// lockedStore implements LockedStorer, adding writes to the reads of readOnlyStore
+// It is only handed out while the store's write lock is held, RLockFunc hands out a readOnlyStore which can't be
+// asserted to a LockedStorer.
+type lockedStore struct {
+	readOnlyStore
+}
+
+// RLockFunc calls cb while holding the store's read lock, allowing multiple reads to be performed atomically with
+// respect to writers
+// The store's own methods acquire the lock themselves, so MUST NOT be called from within cb, use the supplied
+// ReadOnlyStorer instead. Any OnAccess hook is called for the items read after cb returns and the lock is released.
+func (s *Store) RLockFunc(cb func(ReadOnlyStorer)) {
+	l := &readOnlyStore{s: s}
+	s.rlockOpen()
+	onAccess := s.onAccess
+	func() {
+		defer s.RUnlock()
+		cb(l)
+	}()
+
+	l.notifyAccess(onAccess)
+}
+
+// LockFunc calls cb while holding the store's write lock, allowing multiple reads and writes to be performed
+// atomically
+// cb is passed a LockedStorer rather than the *Store itself: every exported Store method acquires the lock, so would
+// deadlock if called from within cb. Any OnAccess hook is called for the items read after cb returns and the lock is
+// released.
+func (s *Store) LockFunc(cb func(LockedStorer)) {
+	l := &lockedStore{readOnlyStore{s: s}}
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		panic("memdb: use of closed store")
+	}
+	onAccess := s.onAccess
+	func() {
+		defer s.Unlock()
+		cb(l)
+	}()
+
+	l.notifyAccess(onAccess)
+}
+
+// notifyAccess calls the OnAccess hook for each item read, must be called without the store's lock held
+func (l *readOnlyStore) notifyAccess(onAccess func(item interface{})) {
+	if onAccess == nil {
+		return
+	}
+	for _, item := range l.accessed {
+		onAccess(item)
+	}
+}
+
+// Get returns an item equal to the passed item from the store
+func (l *readOnlyStore) Get(search interface{}) interface{} {
+	item := l.s.get(search)
+	if item != nil {
+		l.accessed = append(l.accessed, item)
+	}
+	return item
+}
+
+// Contains returns whether an item equal to the passed item exists in the store
+func (l *readOnlyStore) Contains(search interface{}) bool {
+	return l.s.contains(search)
+}
+
+// Lookup returns the list of items from the index for fields that match given key
+func (l *readOnlyStore) Lookup(fields []string, keys ...string) []interface{} {
+	idx, ok := l.s.indexes[strings.Join(fields, "\000")]
+	if !ok {
+		return nil
+	}
+	items := idx.lookup(keys)
+	l.accessed = append(l.accessed, items...)
+	return items
+}
+
+// Len returns the number of items in the database
+func (l *readOnlyStore) Len() int {
+	return l.s.backing.Len()
+}
+
+// Ascend calls provided callback function from start (lowest order) of items until end or iterator function returns
+// false
+func (l *readOnlyStore) Ascend(cb Iterator) {
+	traverse(l.s.backing.AscendRange, nil, nil, l.s.cbWrap(cb))
+}
+
+// AscendStarting calls provided callback function from item equal to at until end or iterator function returns false
+func (l *readOnlyStore) AscendStarting(at interface{}, cb Iterator) {
+	traverse(l.s.backing.AscendRange, &wrap{storer: l.s, item: at}, nil, l.s.cbWrap(cb))
+}
+
+// Descend calls provided callback function from end (highest order) of items until start or iterator function returns
+// false
+func (l *readOnlyStore) Descend(cb Iterator) {
+	traverse(l.s.backing.DescendRange, nil, nil, l.s.cbWrap(cb))
+}
+
+// DescendStarting calls provided callback function from item equal to at until start or iterator function returns false
+func (l *readOnlyStore) DescendStarting(at interface{}, cb Iterator) {
+	traverse(l.s.backing.DescendRange, &wrap{storer: l.s, item: at}, nil, l.s.cbWrap(cb))
+}
+
+// Put places an item into the store, returns the old replaced item (if any)
+func (l *lockedStore) Put(item interface{}) (interface{}, error) {
+	return l.s.put(item)
+}
+
+// Delete removes an item equal to the search item, returns the deleted item (if any)
+func (l *lockedStore) Delete(search interface{}) (interface{}, error) {
+	return l.s.delete(search)
+}
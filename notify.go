@@ -1,10 +1,34 @@
 package memdb
 
 type happening struct {
-	event Event
-	old   interface{}
-	new   interface{}
-	stats Stats
+	event    Event
+	old      interface{}
+	new      interface{}
+	stats    Stats
+	changes  []Change
+	crossing *crossing
+}
+
+// happeningLanes is the number of goroutines that emit events with parallel notification, one for each event type
+// plus one each for batches and size crossings
+const happeningLanes = int(Access) + 3
+
+// lane returns which of the parallel notification goroutines emits the happening
+func (h *happening) lane() int {
+	switch {
+	case h.changes != nil:
+		return happeningLanes - 2
+	case h.crossing != nil:
+		return happeningLanes - 1
+	}
+	return int(h.event)
+}
+
+// crossing is a size watermark having been crossed, to be delivered to a SizeFunc
+type crossing struct {
+	notify SizeFunc
+	count  int
+	rising bool
 }
 
 // Event is a type of event emitted by the class, see the On() method
@@ -42,9 +66,78 @@ const (
 	// Expiry Events happen when items are removed due to being expired
 	Expiry
 
-	// Access Events happen when items are read
+	// Access Events happen when items are read, via Get, index lookups or traversals, old and new are both the item read
 	Access
 )
 
+// ExpiryReason is the reason an item was expired, as given in the Stats of its Expiry event
+type ExpiryReason int
+
+// String describes the expiry reason
+func (r ExpiryReason) String() string {
+	switch r {
+	case NotExpired:
+		return "Not expired"
+	case AgeExpired:
+		return "Age expired"
+	case TTLExpired:
+		return "TTL expired"
+	case Evicted:
+		return "Evicted"
+	case SizeEvicted:
+		return "Size evicted"
+	case Manual:
+		return "Manually expired"
+	default:
+		break
+	}
+	return "Unknown reason"
+}
+
+const (
+	// NotExpired is the reason given in the Stats of all events other than Expiry events
+	NotExpired ExpiryReason = iota
+
+	// AgeExpired items were expired by the store's Expirer (or their own IsExpired) due to their age
+	AgeExpired
+
+	// TTLExpired items were expired by their own time to live, such as given by a LayeredExpirer's TTLFunc
+	TTLExpired
+
+	// Evicted items were removed to make room for newer items, such as by an index's CapBucket
+	Evicted
+
+	// SizeEvicted items were removed to reduce the size of the store, for use by ExpiryReasoners
+	SizeEvicted
+
+	// Manual items were expired on request of the application, for use by ExpiryReasoners
+	Manual
+)
+
 // NotifyFunc is an event receiver that gets called when events happen
+// The stats are a snapshot of the item's statistics at the time of the event.
 type NotifyFunc func(event Event, old, new interface{}, stats Stats)
+
+// ExpiringFunc is a hook called with an item that is about to be expired, return false to keep the item
+type ExpiringFunc func(item interface{}, stats Stats) bool
+
+// Change describes a single change delivered as part of a batch to a BatchNotifyFunc
+type Change struct {
+	Event Event
+	Old   interface{}
+	New   interface{}
+	Stats Stats
+
+	// Err is the error from persisting the new item, if it was stored but could not be persisted
+	Err error
+}
+
+// ConflictFunc is a handler called when a put item holds the same key as an existing item in a unique index, return
+// false to reject the put and keep the existing item
+type ConflictFunc func(existing, incoming interface{}) bool
+
+// SizeFunc is a receiver that gets called when the number of items in the store crosses a watermark, see OnSize
+type SizeFunc func(count int, rising bool)
+
+// BatchNotifyFunc is an event receiver that gets called with all of the changes made by a bulk operation
+type BatchNotifyFunc func(changes []Change)
@@ -0,0 +1,77 @@
+package persist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// CompressingPersister is a Persister which gzips items before saving them to the persister it wraps
+// Items are marshalled to JSON, compressed and passed to the wrapped persister as an *Envelope. Items which were stored
+// before compression was introduced, either as plain items or envelopes of uncompressed data, are loaded as they are
+// and are compressed when next saved.
+type CompressingPersister struct {
+	envelopePersister
+}
+
+// gzipMagic is the header that begins all gzip data
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gzipSealer compresses data with gzip
+type gzipSealer struct {
+	level int
+}
+
+func (g *gzipSealer) seal(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, g.level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = zw.Write(data); err != nil {
+		return nil, fmt.Errorf("Unable to compress item: %s", err)
+	}
+	if err = zw.Close(); err != nil {
+		return nil, fmt.Errorf("Unable to compress item: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *gzipSealer) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress item: %s", err)
+	}
+	defer zr.Close()
+
+	data, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress item: %s", err)
+	}
+	return data, nil
+}
+
+// NewCompressingPersister returns a CompressingPersister which saves items compressed with the given gzip level into
+// inner
+// factory is used to instantiate decompressed items, while inner must be created with EnvelopeFactory(factory) as its
+// factory so that it can load the envelopes. The Meta.Size of items is the compressed size.
+func NewCompressingPersister(inner Persister, level int, factory FactoryFunc) (*CompressingPersister, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("Invalid compression level: %d", level)
+	}
+
+	return &CompressingPersister{
+		envelopePersister{
+			inner:   inner,
+			factory: factory,
+			sealer:  &gzipSealer{level: level},
+			plain:   true,
+		},
+	}, nil
+}
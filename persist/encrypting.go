@@ -0,0 +1,70 @@
+package persist
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrCiphertext is returned when loading an encrypted item which is too short or fails authentication, either because
+// it has been tampered with or because it was encrypted with a different key
+var ErrCiphertext = errors.New("persist: unable to decrypt item")
+
+// EncryptingPersister is a Persister which encrypts items with AES-GCM before saving them to the persister it wraps
+// Items are marshalled to JSON, encrypted with a random nonce which is stored ahead of the ciphertext, and passed to the
+// wrapped persister as an *Envelope. Item ids are not encrypted. Items which were not stored encrypted fail to load.
+type EncryptingPersister struct {
+	envelopePersister
+}
+
+// gcmSealer seals data with AES-GCM
+type gcmSealer struct {
+	aead cipher.AEAD
+}
+
+func (g *gcmSealer) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, g.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %s", err)
+	}
+	return g.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (g *gcmSealer) open(data []byte) ([]byte, error) {
+	n := g.aead.NonceSize()
+	if len(data) < n {
+		return nil, ErrCiphertext
+	}
+
+	plain, err := g.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, ErrCiphertext
+	}
+	return plain, nil
+}
+
+// NewEncryptingPersister returns an EncryptingPersister which saves items encrypted with key into inner
+// key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256. factory is used to instantiate decrypted
+// items, while inner must be created with EnvelopeFactory(factory) as its factory so that it can load the envelopes.
+func NewEncryptingPersister(inner Persister, key []byte, factory FactoryFunc) (*EncryptingPersister, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encryption key: %s", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create GCM cipher: %s", err)
+	}
+
+	return &EncryptingPersister{
+		envelopePersister{
+			inner:   inner,
+			factory: factory,
+			sealer:  &gcmSealer{aead: aead},
+		},
+	}, nil
+}
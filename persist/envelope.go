@@ -0,0 +1,188 @@
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Envelope holds an item in a transformed (e.g. encrypted) form, it is the item that wrapping persisters such as
+// EncryptingPersister pass to the persister they wrap
+type Envelope struct {
+	// Type is the type name of the enclosed item, as passed to a FactoryFunc when loading
+	Type string `json:"type"`
+
+	// Data is the transformed JSON of the enclosed item
+	Data []byte `json:"data"`
+}
+
+// EnvelopeFactory returns a FactoryFunc for the persister being wrapped, which returns an *Envelope for envelopes and
+// defers to factory for any other type, such as items which were stored before the wrapper was introduced
+func EnvelopeFactory(factory FactoryFunc) FactoryFunc {
+	envelopeType := fmt.Sprintf("%T", &Envelope{})
+	return func(indexerType string) interface{} {
+		if indexerType == envelopeType {
+			return &Envelope{}
+		}
+		if factory == nil {
+			return nil
+		}
+		return factory(indexerType)
+	}
+}
+
+// sealer transforms the JSON of items to and from the form they are stored in
+type sealer interface {
+	seal(data []byte) ([]byte, error)
+	open(data []byte) ([]byte, error)
+}
+
+// envelopePersister is a MetaPersister which seals items into Envelopes and saves them to the persister it wraps
+type envelopePersister struct {
+	inner   Persister
+	factory FactoryFunc
+	sealer  sealer
+	onError ErrorFunc
+
+	// plain is whether items which were not stored in an envelope may be loaded as they are
+	plain bool
+}
+
+// SetErrorFunc sets a function to be called with the id and error of each item that fails to be opened when loading
+func (e *envelopePersister) SetErrorFunc(onError ErrorFunc) {
+	e.onError = onError
+}
+
+// SetLogger passes logger to the wrapped persister, if it is Loggable
+func (e *envelopePersister) SetLogger(logger LogFunc) {
+	if loggable, ok := e.inner.(Loggable); ok {
+		loggable.SetLogger(logger)
+	}
+}
+
+func (e *envelopePersister) envelop(indexer interface{}) (*Envelope, error) {
+	data, err := json.Marshal(indexer)
+	if err != nil {
+		return nil, fmt.Errorf("Indexer objects must be JSON marshallable to be enveloped\n%#v\n", err)
+	}
+
+	data, err = e.sealer.seal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Type: fmt.Sprintf("%T", indexer),
+		Data: data,
+	}, nil
+}
+
+func (e *envelopePersister) unenvelop(item interface{}) (interface{}, error) {
+	env, ok := item.(*Envelope)
+	if !ok {
+		if e.plain {
+			return item, nil
+		}
+		return nil, fmt.Errorf("Item of type %T was not stored in an envelope", item)
+	}
+
+	data, err := e.sealer.open(env.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	indexer := e.factory(env.Type)
+	if indexer == nil {
+		return nil, fmt.Errorf("Unable to get factory for type %s", env.Type)
+	}
+
+	if err = json.Unmarshal(data, indexer); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal item for type %T: %#v", indexer, err)
+	}
+	return indexer, nil
+}
+
+// Save is an implementation of the Persister.Save method
+func (e *envelopePersister) Save(id string, indexer interface{}) error {
+	_, err := e.MetaSave(id, indexer)
+	return err
+}
+
+// MetaSave is an implementation of the MetaPersister.MetaSave method
+func (e *envelopePersister) MetaSave(id string, indexer interface{}) (*Meta, error) {
+	env, err := e.envelop(indexer)
+	if err != nil {
+		return nil, err
+	}
+
+	// The inner persister only sees the envelope, so the size reported is always that of the sealed data
+	if metaPersister, ok := e.inner.(MetaPersister); ok {
+		_, err = metaPersister.MetaSave(id, env)
+	} else {
+		err = e.inner.Save(id, env)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Meta{Size: uint64(len(env.Data))}, nil
+}
+
+// Load is an implementation of the Persister.Load method
+func (e *envelopePersister) Load(loadFunc LoadFunc) error {
+	return e.MetaLoad(func(id string, indexer interface{}, meta *Meta) {
+		loadFunc(id, indexer)
+	})
+}
+
+// MetaLoad is an implementation of the MetaPersister.MetaLoad method
+func (e *envelopePersister) MetaLoad(loadFunc MetaLoadFunc) error {
+	loadErr := &LoadError{}
+
+	open := func(id string, item interface{}, meta *Meta) {
+		indexer, err := e.unenvelop(item)
+		if err != nil {
+			loadErr.Failed++
+			loadErr.Last = err
+			if e.onError != nil {
+				e.onError(id, err)
+			}
+			return
+		}
+
+		m := &Meta{}
+		if meta != nil {
+			*m = *meta
+		}
+		if env, ok := item.(*Envelope); ok {
+			m.Size = uint64(len(env.Data))
+		}
+		loadFunc(id, indexer, m)
+	}
+
+	var err error
+	if metaPersister, ok := e.inner.(MetaPersister); ok {
+		err = metaPersister.MetaLoad(open)
+	} else {
+		err = e.inner.Load(func(id string, item interface{}) {
+			open(id, item, nil)
+		})
+	}
+
+	if innerErr, ok := err.(*LoadError); ok {
+		loadErr.Failed += innerErr.Failed
+		if loadErr.Last == nil {
+			loadErr.Last = innerErr.Last
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if loadErr.Failed > 0 {
+		return loadErr
+	}
+	return nil
+}
+
+// Remove is an implementation of the Persister.Remove method
+func (e *envelopePersister) Remove(id string) error {
+	return e.inner.Remove(id)
+}
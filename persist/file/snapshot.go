@@ -0,0 +1,178 @@
+package filepersist
+
+import (
+	"github.com/nedscode/memdb/persist"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// SnapshotPersister is a memdb Persister that stores the entire store as a single JSON file
+// Saved and removed items are only held in memory until Checkpoint is called, which writes all of the items to a
+// temporary file and renames it over the previous snapshot, so the snapshot on disk is always a complete image of the
+// store as at a checkpoint. Changes made since the last checkpoint are lost if the process exits.
+type SnapshotPersister struct {
+	sync.Mutex
+
+	file    string
+	storage *Storage
+	items   map[string]*container
+}
+
+// NewSnapshotPersister creates a new SnapshotPersister which stores its snapshot in file
+// factory is a factory function that can instantiate a new instance of an Indexer
+func NewSnapshotPersister(file string, factory persist.FactoryFunc) (*SnapshotPersister, error) {
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+
+	return &SnapshotPersister{
+		file: file,
+		storage: &Storage{
+			factory: factory,
+			codec:   JSONCodec{},
+		},
+		items: map[string]*container{},
+	}, nil
+}
+
+// SetLogger is an implementation of the Loggable.SetLogger method
+func (p *SnapshotPersister) SetLogger(logger persist.LogFunc) {
+	p.storage.SetLogger(logger)
+}
+
+// SetErrorFunc sets a function to be called with the id and error of each item that fails to load
+func (p *SnapshotPersister) SetErrorFunc(onError persist.ErrorFunc) {
+	p.storage.SetErrorFunc(onError)
+}
+
+// Save is an implementation of the Persister.Save method
+// The item is marshalled immediately, so later changes to it are not included in the snapshot until it is saved again.
+func (p *SnapshotPersister) Save(id string, indexer interface{}) error {
+	data, err := json.Marshal(indexer)
+	if err != nil {
+		return fmt.Errorf("Indexer objects must be JSON marshallable to use FilePersist storage\n%#v\n", err)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.items[id] = &container{
+		ID:   id,
+		Type: fmt.Sprintf("%T", indexer),
+		Item: data,
+	}
+	return nil
+}
+
+// Remove is an implementation of the Persister.Remove method
+func (p *SnapshotPersister) Remove(id string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.items, id)
+	return nil
+}
+
+// Truncate is an implementation of the Truncater.Truncate method
+func (p *SnapshotPersister) Truncate() error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.items = map[string]*container{}
+	return nil
+}
+
+// Checkpoint writes all of the items to the snapshot file, replacing the previous snapshot atomically
+func (p *SnapshotPersister) Checkpoint() error {
+	p.Lock()
+	items := make([]*container, 0, len(p.items))
+	for _, c := range p.items {
+		items = append(items, c)
+	}
+	p.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal snapshot: %#v", err)
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(p.file), path.Base(p.file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create snapshot file: %#v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write snapshot file %s: %#v", tmp.Name(), err)
+	}
+
+	if err = os.Rename(tmp.Name(), p.file); err != nil {
+		return fmt.Errorf("Unable to replace snapshot file %s: %#v", p.file, err)
+	}
+	return nil
+}
+
+// Load is an implementation of the Persister.Load method
+// Loading a snapshot which does not exist yet loads no items.
+func (p *SnapshotPersister) Load(loadFunc persist.LoadFunc) error {
+	data, err := ioutil.ReadFile(p.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to read snapshot file %s: %#v", p.file, err)
+	}
+
+	var items []*container
+	if err = json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("Unable to parse snapshot file %s: %#v", p.file, err)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	s := p.storage
+	var loadErr *persist.LoadError
+	for _, c := range items {
+		item, err := s.newItem(c.Type)
+		if err == nil {
+			err = s.decodeItem(c, item)
+		}
+
+		if err != nil {
+			s.log("warn", "skipped item: unable to load from snapshot", "id", c.ID, "error", err)
+			if s.onError != nil {
+				s.onError(c.ID, err)
+			}
+			if loadErr == nil {
+				loadErr = &persist.LoadError{}
+			}
+			loadErr.Failed++
+			loadErr.Last = err
+			continue
+		}
+
+		p.items[c.ID] = c
+		loadFunc(c.ID, item)
+	}
+
+	if loadErr != nil {
+		return loadErr
+	}
+	return nil
+}
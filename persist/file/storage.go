@@ -12,10 +12,14 @@ import (
 )
 
 // Storage is a simple memdb Persister that stores and loads files as JSON from a folder on a drive somewhere,
-// to use this persister, you should ensure your Indexers are JSON Marshalable.
+// to use this persister, you should ensure your Indexers are JSON Marshalable (or marshalable by the Codec set with
+// WithCodec).
 type Storage struct {
 	folder  string
 	factory persist.FactoryFunc
+	codec   Codec
+	logger  persist.LogFunc
+	onError persist.ErrorFunc
 }
 
 // NewFileStorage creates a new Storage Persister at the designated folder
@@ -35,13 +39,39 @@ func NewFileStorage(folder string, factory persist.FactoryFunc) (*Storage, error
 	return &Storage{
 		folder:  folder,
 		factory: factory,
+		codec:   JSONCodec{},
 	}, nil
 }
 
+// WithCodec sets the Codec used to serialize items, the default is JSONCodec
+// Items stored with a different codec are held in the file's envelope as encoded bytes rather than as JSON. Files
+// previously stored as JSON can still be loaded after changing codec.
+func (s *Storage) WithCodec(codec Codec) *Storage {
+	s.codec = codec
+	return s
+}
+
+// SetLogger is an implementation of the Loggable.SetLogger method
+func (s *Storage) SetLogger(logger persist.LogFunc) {
+	s.logger = logger
+}
+
+// SetErrorFunc sets a function to be called with the id and error of each item that fails to load
+func (s *Storage) SetErrorFunc(onError persist.ErrorFunc) {
+	s.onError = onError
+}
+
+func (s *Storage) log(level, msg string, kv ...interface{}) {
+	if s.logger != nil {
+		s.logger(level, msg, kv...)
+	}
+}
+
 type container struct {
 	ID   string          `json:"id"`
 	Type string          `json:"type"`
-	Item json.RawMessage `json:"item"`
+	Item json.RawMessage `json:"item,omitempty"`
+	Data []byte          `json:"data,omitempty"`
 }
 
 func (s *Storage) writeFile(name string, data []byte) error {
@@ -60,17 +90,26 @@ func (s *Storage) Save(id string, indexer interface{}) error {
 
 // MetaSave is an implementation of the Persister.MetaSave method
 func (s *Storage) MetaSave(id string, indexer interface{}) (meta *persist.Meta, err error) {
-	data, err := json.Marshal(indexer)
+	if !validID(id) {
+		return nil, fmt.Errorf("Unable to save item with id %q, which cannot be used as a file name", id)
+	}
+
+	data, err := s.codec.Marshal(indexer)
 	if err != nil {
-		return nil, fmt.Errorf("Indexer objects must be JSON marshallable to use FilePersist storage\n%#v\n", err)
+		return nil, fmt.Errorf("Indexer objects must be marshallable by the codec to use FilePersist storage\n%#v\n", err)
 	}
 
 	size := uint64(len(data))
-	data, _ = json.Marshal(&container{
+	c := &container{
 		ID:   id,
 		Type: fmt.Sprintf("%T", indexer),
-		Item: data,
-	})
+	}
+	if _, ok := s.codec.(JSONCodec); ok {
+		c.Item = data
+	} else {
+		c.Data = data
+	}
+	data, _ = json.Marshal(c)
 
 	name := path.Join(s.folder, id+".json")
 	err = s.writeFile(name, data)
@@ -106,6 +145,18 @@ func (s *Storage) newItem(t string) (interface{}, error) {
 	return item, nil
 }
 
+// decodeItem decodes the item from the container, using the codec for encoded bytes, otherwise as JSON
+func (s *Storage) decodeItem(c *container, item interface{}) error {
+	if c.Data == nil {
+		return s.unmarshalItem(c.Item, item)
+	}
+
+	if err := s.codec.Unmarshal(c.Data, item); err != nil {
+		return fmt.Errorf("Unable to decode item for type %T: %#v", item, err)
+	}
+	return nil
+}
+
 func (s *Storage) unmarshalItem(data []byte, item interface{}) error {
 	err := json.Unmarshal(data, item)
 	if err != nil {
@@ -128,10 +179,9 @@ func (s *Storage) MetaLoad(loadFunc persist.MetaLoadFunc) error {
 		return fmt.Errorf("Unable to read directory %s: %#v", s.folder, err)
 	}
 
-	var lastErr error
+	var loadErr *persist.LoadError
 	for _, fi := range dir {
-		nom := strings.Split(fi.Name(), ".")
-		if len(nom) == 2 && len(nom[0]) == 12 && nom[1] == "json" {
+		if isItemFile(fi.Name()) {
 			name := path.Join(s.folder, fi.Name())
 			data, err := s.readFile(name)
 
@@ -149,22 +199,45 @@ func (s *Storage) MetaLoad(loadFunc persist.MetaLoadFunc) error {
 			}
 
 			if err == nil {
-				err = s.unmarshalItem(c.Item, item)
+				err = s.decodeItem(c, item)
 			}
 
 			if err == nil {
 				loadFunc(c.ID, item, &persist.Meta{
-					Size: uint64(len(c.Item)),
+					Size: uint64(len(c.Item) + len(c.Data)),
 				})
 			}
 
 			if err != nil {
-				lastErr = err
+				s.log("warn", "skipped item: unable to load file", "file", name, "error", err)
+				if s.onError != nil {
+					s.onError(strings.TrimSuffix(fi.Name(), ".json"), err)
+				}
+				if loadErr == nil {
+					loadErr = &persist.LoadError{}
+				}
+				loadErr.Failed++
+				loadErr.Last = err
 			}
 		}
 	}
 
-	return lastErr
+	if loadErr != nil {
+		return loadErr
+	}
+	return nil
+}
+
+// isItemFile returns whether the file name is that of a stored item
+func isItemFile(name string) bool {
+	return strings.HasSuffix(name, ".json") && validID(strings.TrimSuffix(name, ".json"))
+}
+
+// validID returns whether the id can be used as the name of an item's file within the folder
+// Ids set with SetUIDFunc may be of any form, but must not be empty or contain path separators which would take the
+// file outside of the folder.
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, "/\\\x00")
 }
 
 func (s *Storage) removeFile(name string) error {
@@ -176,6 +249,27 @@ func (s *Storage) removeFile(name string) error {
 
 // Remove is an implementation of the Persister.Remove method
 func (s *Storage) Remove(id string) error {
+	if !validID(id) {
+		return fmt.Errorf("Unable to remove item with id %q, which cannot be used as a file name", id)
+	}
 	name := path.Join(s.folder, id+".json")
 	return s.removeFile(name)
 }
+
+// Truncate is an implementation of the Truncater.Truncate method
+func (s *Storage) Truncate() error {
+	dir, err := ioutil.ReadDir(s.folder)
+	if err != nil {
+		return fmt.Errorf("Unable to read directory %s: %#v", s.folder, err)
+	}
+
+	var lastErr error
+	for _, fi := range dir {
+		if isItemFile(fi.Name()) {
+			if err := s.removeFile(path.Join(s.folder, fi.Name())); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
@@ -1,7 +1,14 @@
 package filepersist
 
 import (
+	"github.com/nedscode/memdb/persist"
+
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -202,3 +209,306 @@ func TestLoadUnparse(t *testing.T) {
 		t.Errorf("Expected error removing not-a-file")
 	}
 }
+
+func TestLoadLogsSkipped(t *testing.T) {
+	s, err := NewFileStorage("/tmp/filestore-log", func(indexerType string) interface{} {
+		return nil
+	})
+	defer os.RemoveAll("/tmp/filestore-log")
+
+	if err != nil {
+		t.Errorf("Unexpected error creating new storage: %#v", err)
+	}
+
+	var logged []string
+	s.SetLogger(func(level, msg string, kv ...interface{}) {
+		logged = append(logged, level+": "+msg)
+	})
+
+	s.Save("123456789012", &X{A: 1})
+	if err = s.Load(func(id string, indexer interface{}) {}); err == nil {
+		t.Errorf("Expected error loading unknown type")
+	}
+
+	if len(logged) != 1 || logged[0] != "warn: skipped item: unable to load file" {
+		t.Errorf("Expected a single skipped item warning (got %#v)", logged)
+	}
+}
+
+func TestLoadErrorFunc(t *testing.T) {
+	s, err := NewFileStorage("/tmp/filestore-errors", func(indexerType string) interface{} {
+		return &X{}
+	})
+	defer os.RemoveAll("/tmp/filestore-errors")
+
+	if err != nil {
+		t.Errorf("Unexpected error creating new storage: %#v", err)
+	}
+
+	var failed []string
+	s.SetErrorFunc(func(id string, err error) {
+		failed = append(failed, id)
+	})
+
+	s.Save("123456789012", &X{A: 1})
+	ioutil.WriteFile("/tmp/filestore-errors/210987654321.json", []byte("corrupt"), 0644)
+	ioutil.WriteFile("/tmp/filestore-errors/333333333333.json", []byte("{}"), 0644)
+
+	loaded := 0
+	err = s.Load(func(id string, indexer interface{}) {
+		loaded++
+	})
+
+	loadErr, ok := err.(*persist.LoadError)
+	if !ok || loadErr.Failed != 2 {
+		t.Errorf("Expected load error reporting 2 failures (got %#v)", err)
+	}
+	if loaded != 1 {
+		t.Errorf("Expected the valid item to load (got %d)", loaded)
+	}
+	sort.Strings(failed)
+	if len(failed) != 2 || failed[0] != "210987654321" || failed[1] != "333333333333" {
+		t.Errorf("Expected failed ids to be reported (got %#v)", failed)
+	}
+}
+
+func TestGobCodec(t *testing.T) {
+	s, err := NewFileStorage("/tmp/filestore-gob", func(indexerType string) interface{} {
+		return &X{}
+	})
+	defer os.RemoveAll("/tmp/filestore-gob")
+
+	if err != nil {
+		t.Errorf("Unexpected error creating new storage: %#v", err)
+	}
+
+	// Stored as JSON before the codec is changed
+	s.Save("123456789012", &X{A: 1, B: "json"})
+	s.WithCodec(GobCodec{})
+	s.Save("210987654321", &X{A: 2, B: "gob"})
+
+	got := map[string]string{}
+	err = s.Load(func(id string, indexer interface{}) {
+		got[id] = indexer.(*X).B
+	})
+	if err != nil {
+		t.Errorf("Unexpected error loading: %s", err)
+	}
+	if got["123456789012"] != "json" || got["210987654321"] != "gob" {
+		t.Errorf("Expected both JSON and gob items to load (got %#v)", got)
+	}
+}
+
+func TestEncrypting(t *testing.T) {
+	factory := func(indexerType string) interface{} {
+		return &X{}
+	}
+	fs, err := NewFileStorage("/tmp/filestore-encrypt", persist.EnvelopeFactory(factory))
+	defer os.RemoveAll("/tmp/filestore-encrypt")
+
+	if err != nil {
+		t.Errorf("Unexpected error creating new storage: %#v", err)
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	s, err := persist.NewEncryptingPersister(fs, key, factory)
+	if err != nil {
+		t.Errorf("Unexpected error creating encrypting persister: %#v", err)
+	}
+
+	if err = s.Save("123456789012", &X{A: 1, B: "secret"}); err != nil {
+		t.Errorf("Unexpected error saving: %s", err)
+	}
+
+	data, _ := ioutil.ReadFile("/tmp/filestore-encrypt/123456789012.json")
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("Expected item to be encrypted at rest (got %s)", data)
+	}
+
+	var got *X
+	err = s.Load(func(id string, indexer interface{}) {
+		got = indexer.(*X)
+	})
+	if err != nil || got == nil || got.B != "secret" {
+		t.Errorf("Expected item to decrypt (got %#v, %v)", got, err)
+	}
+
+	other, _ := persist.NewEncryptingPersister(fs, []byte("fedcba9876543210fedcba9876543210"), factory)
+	err = other.Load(func(id string, indexer interface{}) {
+		t.Errorf("Expected item not to load with the wrong key")
+	})
+	if loadErr, ok := err.(*persist.LoadError); !ok || loadErr.Last != persist.ErrCiphertext {
+		t.Errorf("Expected ciphertext error loading with the wrong key (got %#v)", err)
+	}
+
+	if _, err = persist.NewEncryptingPersister(fs, []byte("short"), factory); err == nil {
+		t.Errorf("Expected error for invalid key")
+	}
+}
+
+func TestCompressing(t *testing.T) {
+	factory := func(indexerType string) interface{} {
+		return &X{}
+	}
+	fs, err := NewFileStorage("/tmp/filestore-compress", persist.EnvelopeFactory(factory))
+	defer os.RemoveAll("/tmp/filestore-compress")
+
+	if err != nil {
+		t.Errorf("Unexpected error creating new storage: %#v", err)
+	}
+
+	// Stored before compression was introduced
+	fs.Save("111111111111", &X{A: 1, B: "plain"})
+
+	s, err := persist.NewCompressingPersister(fs, gzip.BestCompression, factory)
+	if err != nil {
+		t.Errorf("Unexpected error creating compressing persister: %#v", err)
+	}
+
+	long := strings.Repeat("compressible ", 100)
+	meta, err := s.MetaSave("222222222222", &X{A: 2, B: long})
+	if err != nil {
+		t.Errorf("Unexpected error saving: %s", err)
+	}
+	if meta.Size == 0 || meta.Size >= uint64(len(long)) {
+		t.Errorf("Expected compressed size to be smaller than the item (got %d)", meta.Size)
+	}
+
+	got := map[string]string{}
+	err = s.MetaLoad(func(id string, indexer interface{}, meta *persist.Meta) {
+		got[id] = indexer.(*X).B
+	})
+	if err != nil {
+		t.Errorf("Unexpected error loading: %s", err)
+	}
+	if got["111111111111"] != "plain" || got["222222222222"] != long {
+		t.Errorf("Expected both plain and compressed items to load (got %#v)", got)
+	}
+
+	if _, err = persist.NewCompressingPersister(fs, 42, factory); err == nil {
+		t.Errorf("Expected error for invalid compression level")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	s, err := NewFileStorage("/tmp/filetruncate", func(indexerType string) interface{} {
+		return &X{}
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error creating new storage: %#v", err)
+	}
+
+	s.Save("123456789012", &X{A: 1})
+	s.Save("210987654321", &X{A: 2})
+
+	if err = s.Truncate(); err != nil {
+		t.Errorf("Unexpected error truncating storage: %#v", err)
+	}
+
+	loaded := 0
+	s.Load(func(id string, indexer interface{}) {
+		loaded++
+	})
+	if loaded != 0 {
+		t.Errorf("Expected no items to load after truncate (got %d)", loaded)
+	}
+}
+
+func TestCustomUIDs(t *testing.T) {
+	defer os.RemoveAll("/tmp/filestore-uids")
+	s, err := NewFileStorage("/tmp/filestore-uids", func(indexerType string) interface{} {
+		return &X{}
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error creating new storage: %#v", err)
+	}
+
+	ids := []string{"C38-11-A", "x", "sku.1234567890123"}
+	for i, id := range ids {
+		if err = s.Save(id, &X{A: i}); err != nil {
+			t.Errorf("Unexpected error saving %s: %s", id, err)
+		}
+	}
+	for _, id := range []string{"../escape", "a/b", "..", ""} {
+		if err = s.Save(id, &X{}); err == nil {
+			t.Errorf("Expected error saving id %q outside of the folder", id)
+		}
+	}
+	if _, err = os.Stat("/tmp/escape.json"); err == nil {
+		t.Errorf("Expected no file to be written outside of the folder")
+	}
+
+	loaded := map[string]int{}
+	if err = s.Load(func(id string, indexer interface{}) {
+		loaded[id] = indexer.(*X).A
+	}); err != nil {
+		t.Errorf("Unexpected error loading: %s", err)
+	}
+	if len(loaded) != len(ids) || loaded["C38-11-A"] != 0 || loaded["sku.1234567890123"] != 2 {
+		t.Errorf("Expected items saved under custom UIDs to load (got %#v)", loaded)
+	}
+
+	if err = s.Truncate(); err != nil {
+		t.Errorf("Unexpected error truncating storage: %#v", err)
+	}
+	if files, _ := ioutil.ReadDir("/tmp/filestore-uids"); len(files) != 0 {
+		t.Errorf("Expected truncate to remove all items (got %d files)", len(files))
+	}
+}
+
+func TestSnapshotPersister(t *testing.T) {
+	defer os.RemoveAll("/tmp/filestore-snapshot")
+	file := "/tmp/filestore-snapshot/snapshot.json"
+	factory := func(indexerType string) interface{} {
+		return &X{}
+	}
+
+	p, err := NewSnapshotPersister(file, factory)
+	if err != nil {
+		t.Errorf("Unexpected error creating snapshot persister: %#v", err)
+	}
+
+	if err = p.Load(func(id string, indexer interface{}) {
+		t.Errorf("Expected no items before the first checkpoint")
+	}); err != nil {
+		t.Errorf("Unexpected error loading missing snapshot: %s", err)
+	}
+
+	p.Save("111111111111", &X{A: 1})
+	p.Save("222222222222", &X{A: 2})
+	if err = p.Checkpoint(); err != nil {
+		t.Errorf("Unexpected error checkpointing: %s", err)
+	}
+
+	// Not included until the next checkpoint
+	p.Remove("111111111111")
+	p.Save("333333333333", &X{A: 3})
+
+	loaded := map[string]int{}
+	p, _ = NewSnapshotPersister(file, factory)
+	p.Load(func(id string, indexer interface{}) {
+		loaded[id] = indexer.(*X).A
+	})
+	if len(loaded) != 2 || loaded["111111111111"] != 1 || loaded["222222222222"] != 2 {
+		t.Errorf("Expected the checkpointed items to load (got %#v)", loaded)
+	}
+
+	p.Remove("111111111111")
+	p.Checkpoint()
+
+	loaded = map[string]int{}
+	p, _ = NewSnapshotPersister(file, factory)
+	p.Load(func(id string, indexer interface{}) {
+		loaded[id] = indexer.(*X).A
+	})
+	if len(loaded) != 1 || loaded["222222222222"] != 2 {
+		t.Errorf("Expected loaded items to be kept in later snapshots (got %#v)", loaded)
+	}
+
+	files, _ := ioutil.ReadDir("/tmp/filestore-snapshot")
+	if len(files) != 1 {
+		t.Errorf("Expected temporary files to be removed (got %d files)", len(files))
+	}
+}
@@ -1,6 +1,9 @@
-// Package persist defines interfaces for building Persister implementations for memdb
+// Package persist defines interfaces for building Persister implementations for memdb, and Persisters which wrap
+// others to transform the stored items
 package persist
 
+import "fmt"
+
 // FactoryFunc is a function which will return an interface of a named type for decoding the stored Indexer into.
 type FactoryFunc func(indexerType string) interface{}
 
@@ -37,3 +40,39 @@ type MetaPersister interface {
 type Meta struct {
 	Size uint64
 }
+
+// Truncater is an interface for Persisters which are able to remove all of their stored items at once
+type Truncater interface {
+	// Truncate is called when the store is cleared and all persisted items need removal from persistent store
+	Truncate() error
+}
+
+// ErrorFunc is a function which receives the error for an individual item that could not be loaded
+type ErrorFunc func(id string, err error)
+
+// LoadError is returned by a Persister's Load when some of the persisted items could not be loaded
+type LoadError struct {
+	// Failed is the number of items which could not be loaded
+	Failed int
+
+	// Last is the error for the last item which could not be loaded
+	Last error
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("%d items failed to load, last error: %s", e.Failed, e.Last)
+}
+
+// Unwrap returns the error for the last item which could not be loaded
+func (e *LoadError) Unwrap() error {
+	return e.Last
+}
+
+// LogFunc is a function which receives structured log messages, kv is a list of alternating keys and values
+type LogFunc func(level, msg string, kv ...interface{})
+
+// Loggable is an interface for Persisters which are able to emit warnings via a LogFunc
+type Loggable interface {
+	// SetLogger sets the function that log messages are emitted to
+	SetLogger(logger LogFunc)
+}
@@ -0,0 +1,28 @@
+package memdb
+
+import "context"
+
+// Reader provides query only access to a store, allowing code to be handed a store which it cannot modify
+type Reader interface {
+	Get(search interface{}) interface{}
+	Contains(search interface{}) bool
+	InPrimaryKey() IndexSearcher
+	In(fields ...string) IndexSearcher
+
+	Ascend(cb Iterator)
+	AscendContext(ctx context.Context, cb Iterator)
+	AscendStarting(at interface{}, cb Iterator)
+	Descend(cb Iterator)
+	DescendContext(ctx context.Context, cb Iterator)
+	DescendStarting(at interface{}, cb Iterator)
+
+	Len() int
+	Keys(fields ...string) []string
+	Indexes() [][]string
+	IndexStats(fields ...string) []*IndexStats
+}
+
+// Reader returns the store as a Reader, for passing to code which should only query it
+func (s *Store) Reader() Reader {
+	return s
+}
@@ -1,8 +1,12 @@
 package memdb
 
 import (
+	"net"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type R struct {
@@ -15,6 +19,7 @@ type R struct {
 	Float32 float32
 	Bool    bool
 	Map     map[string]map[int]string
+	Attrs   map[string]string
 }
 
 func Test_reflective(t *testing.T) {
@@ -57,8 +62,195 @@ func Test_reflective(t *testing.T) {
 	assertStr(t, r, "float32", "9.999999717e-10")
 	assertStr(t, r, "bool", "false")
    	assertStr(t, r, "map.aaa.5", "Hello")
+	assertStr(t, r, "map.AAA.5", "Hello")
+	assertStr(t, r, "map.aaa.6", "")
 
-	assertStr(t, r, "struct", "{[] <nil> Values 500 5000 5000.0000001 0 true map[]}")
+	assertStr(t, r, "struct", "{[] <nil> Values 500 5000 5000.0000001 0 true map[] map[]}")
+}
+
+func Test_reflectiveMap(t *testing.T) {
+	r := &R{
+		Attrs: map[string]string{
+			"color":  "red",
+			"Finish": "matte",
+		},
+	}
+
+	assertStr(t, r, "attrs.color", "red")
+	assertStr(t, r, "attrs.Finish", "matte")
+	assertStr(t, r, "attrs.finish", "matte")
+	assertStr(t, r, "attrs.size", "")
+
+	s := NewStore()
+	s.CreateIndex("attrs.color")
+	s.Put(r)
+	if got := s.In("attrs.color").One("red"); got != r {
+		t.Errorf("Expected to find item by map field index (got %#v)", got)
+	}
+}
+
+type stamped struct {
+	At    time.Time
+	Ptr   *time.Time
+	Addr  net.IP
+	Level level
+}
+
+type level int
+
+func (l level) String() string {
+	return "level"
+}
+
+func Test_reflectiveTime(t *testing.T) {
+	early := time.Date(2020, 1, 2, 3, 4, 5, 100000000, time.UTC)
+	zoned := time.Date(2020, 1, 2, 3, 4, 5, 120000000, time.FixedZone("X", 3600))
+	r := &stamped{At: early, Ptr: &zoned, Addr: net.IPv4(10, 0, 0, 1), Level: 3}
+
+	assertStr(t, r, "at", "2020-01-02T03:04:05.100000000Z")
+	assertStr(t, r, "ptr", "2020-01-02T02:04:05.120000000Z")
+	assertStr(t, r, "addr", "10.0.0.1")
+	assertStr(t, r, "level", "3")
+
+	if reflective(r, []string{"ptr"}) > reflective(r, []string{"at"}) {
+		t.Errorf("Expected time keys to sort chronologically")
+	}
+}
+
+type tags struct {
+	SKUCode string `json:"sku_code,omitempty"`
+	Name    string `memdb:"title" json:"name"`
+	Title   string
+	Label   string `db:"name"`
+	Alias   string `json:"label"`
+}
+
+func Test_reflectiveTags(t *testing.T) {
+	r := &tags{SKUCode: "A1", Name: "Widget", Title: "Untagged", Label: "Label", Alias: "Alias"}
+
+	assertStr(t, r, "sku_code", "A1")
+	assertStr(t, r, "skucode", "A1")
+	assertStr(t, r, "title", "Widget")
+	assertStr(t, r, "name", "Widget")
+	assertStr(t, r, "label", "Label")
+
+	s := NewStore().SetFieldTag("db")
+	s.CreateIndex("name")
+	s.Put(r)
+	if got := s.In("name").One("Label"); got != r {
+		t.Errorf("Expected to find item by configured tag (got %#v)", got)
+	}
+}
+
+type Audit struct {
+	ID      string
+	Created string
+	Updated string
+}
+
+type Base struct {
+	*Audit
+	ID   string
+	Kind string
+}
+
+type Owner struct {
+	ID string
+}
+
+type embedding struct {
+	Base
+	Owner   `json:"owner"`
+	Updated string
+}
+
+func Test_reflectiveEmbedded(t *testing.T) {
+	r := &embedding{
+		Base:    Base{Audit: &Audit{ID: "audit", Created: "monday", Updated: "tuesday"}, ID: "base", Kind: "car"},
+		Owner:   Owner{ID: "owner"},
+		Updated: "wednesday",
+	}
+
+	assertStr(t, r, "kind", "car")
+	assertStr(t, r, "created", "monday")
+	assertStr(t, r, "id", "base")
+	assertStr(t, r, "updated", "wednesday")
+	assertStr(t, r, "audit.updated", "tuesday")
+	assertStr(t, r, "owner.id", "owner")
+
+	r.Base.Audit = nil
+	assertStr(t, r, "created", "")
+
+	s := NewStore()
+	s.CreateIndex("id")
+	s.Put(r)
+	if got := s.In("id").One("base"); got != r {
+		t.Errorf("Expected to find item by promoted field (got %#v)", got)
+	}
+}
+
+type indirection struct {
+	Payload  interface{}
+	Name     **string
+	Missing  *string
+	Empty    interface{}
+	internal interface{}
+}
+
+func Test_reflectiveIndirection(t *testing.T) {
+	name := "widget"
+	pName := &name
+	r := &indirection{
+		Payload:  &R{Str: "inner"},
+		Name:     &pName,
+		internal: 42,
+	}
+
+	assertStr(t, r, "payload.str", "inner")
+	assertStr(t, r, "name", "widget")
+	assertStr(t, r, "missing", "")
+	assertStr(t, r, "empty", "")
+	assertStr(t, r, "internal", "42")
+
+	var nilR *indirection
+	assertStr(t, nilR, "name", "")
+
+	s := NewStore()
+	s.CreateIndex("payload")
+	s.Put(&indirection{Payload: "text"})
+	if got := s.In("payload").One("text"); got == nil {
+		t.Errorf("Expected to find item by interface field value")
+	}
+}
+
+func Benchmark_fieldIndex(b *testing.B) {
+	vt := reflect.TypeOf(embedding{})
+	r := &reflector{fieldTag: "memdb", fields: &sync.Map{}}
+	r.fieldIndex(vt, "created")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.fieldIndex(vt, "created")
+	}
+}
+
+func Test_reflectiveFloatFormat(t *testing.T) {
+	r := &reflector{floatFormat: 'g', floatPrecision: -1}
+
+	a := r.reflective(&R{Float64: 5000.0000001}, []string{"float64"})
+	b := r.reflective(&R{Float64: 5000}, []string{"float64"})
+	if a == b {
+		t.Errorf("Expected distinct floats to produce distinct keys (got %s and %s)", a, b)
+	}
+	if a != "5000.0000001" {
+		t.Errorf("Expected exact float formatting (got %s)", a)
+	}
+
+	r = &reflector{floatFormat: 'f', floatPrecision: 2}
+	if got := r.reflective(&R{Float32: 1.005}, []string{"float32"}); got != "1.00" {
+		t.Errorf("Expected fixed float formatting (got %s)", got)
+	}
 }
 
 func assertStr(t *testing.T, i interface{}, key, expect string) {
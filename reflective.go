@@ -1,13 +1,49 @@
 package memdb
 
 import (
+	"encoding"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-func reflectiveArray(search string, val reflect.Value, path []string) string {
+// sortableTime is the layout times are formatted with for use as keys, it is fixed width (in UTC) so that the string
+// ordering of keys matches chronological order
+const sortableTime = "2006-01-02T15:04:05.000000000Z07:00"
+
+// reflector finds the string values of fields within items using reflection
+// The index paths of struct fields are cached in fields, by struct type, as they are resolved. As they depend on the
+// fieldTag, the cache must be replaced whenever it is changed.
+type reflector struct {
+	floatFormat    byte
+	floatPrecision int
+	fieldTag       string
+	fields         *sync.Map
+}
+
+// defaultReflector is the reflector used by stores unless configured otherwise
+var defaultReflector = reflector{
+	floatFormat:    'g',
+	floatPrecision: 10,
+	fieldTag:       "memdb",
+	fields:         &sync.Map{},
+}
+
+// typeFields holds the index paths of the fields of a struct type resolved by fieldIndex, by field name
+type typeFields struct {
+	sync.RWMutex
+
+	index map[string][]int
+}
+
+func reflective(a interface{}, path []string) string {
+	return defaultReflector.reflective(a, path)
+}
+
+func (r *reflector) reflectiveArray(search string, val reflect.Value, path []string) string {
 	if search == "" {
 		if val.CanInterface() {
 			return fmt.Sprintf("%v", val.Interface())
@@ -26,14 +62,14 @@ func reflectiveArray(search string, val reflect.Value, path []string) string {
 
 	f := val.Index(int(pos))
 	if f.CanInterface() {
-		return reflective(f.Interface(), path[1:])
-	} else if len(path) == 1 {
-		return staticVal(f.Kind(), f)
+		return r.reflective(f.Interface(), path[1:])
+	} else if f = indirect(f); len(path) == 1 && f.IsValid() {
+		return r.staticVal(f.Kind(), f)
 	}
 	return ""
 }
 
-func reflectiveStruct(search string, val reflect.Value, path []string) string {
+func (r *reflector) reflectiveStruct(search string, val reflect.Value, path []string) string {
 	if search == "" {
 		if val.CanInterface() {
 			return fmt.Sprintf("%v", val.Interface())
@@ -42,25 +78,161 @@ func reflectiveStruct(search string, val reflect.Value, path []string) string {
 	}
 
 	val = reflect.Indirect(val)
-	vt := val.Type()
+	index := r.fieldIndex(val.Type(), search)
+	if index == nil {
+		return ""
+	}
+
+	f := fieldByIndex(val, index)
+	if !f.IsValid() {
+		return ""
+	}
+	if f.CanInterface() {
+		return r.reflective(f.Interface(), path[1:])
+	} else if f = indirect(f); len(path) == 1 && f.IsValid() {
+		return r.staticVal(f.Kind(), f)
+	}
+	return ""
+}
+
+// embedded is a struct type embedded (at any depth) within the struct being searched by fieldIndex
+type embedded struct {
+	typ   reflect.Type
+	index []int
+}
+
+// fieldIndex returns the index sequence of the struct field named search (case insensitive), or nil if there is none
+// Results are cached, so that lookups by comparators and indexes don't repeat the search for every item.
+func (r *reflector) fieldIndex(vt reflect.Type, search string) []int {
+	if r.fields == nil {
+		return r.findFieldIndex(vt, search)
+	}
+
+	cached, ok := r.fields.Load(vt)
+	if !ok {
+		cached, _ = r.fields.LoadOrStore(vt, &typeFields{index: map[string][]int{}})
+	}
+	tf := cached.(*typeFields)
+
+	tf.RLock()
+	index, ok := tf.index[search]
+	tf.RUnlock()
+	if ok {
+		return index
+	}
+
+	index = r.findFieldIndex(vt, search)
+	tf.Lock()
+	tf.index[search] = index
+	tf.Unlock()
+	return index
+}
+
+// findFieldIndex searches the struct type for the field named search, as per fieldIndex
+// The struct's own fields are searched first, then the fields promoted from its embedded structs, depth by depth, so
+// that outer fields shadow those promoted from deeper within. As with Go's own promotion, a name matching fields at the
+// same depth of different embedded structs is ambiguous, so is not found. Embedded structs given a name by a tag are
+// not promoted.
+func (r *reflector) findFieldIndex(vt reflect.Type, search string) []int {
+	level := []embedded{{typ: vt}}
+	visited := map[reflect.Type]bool{}
+	for len(level) > 0 {
+		var (
+			found []int
+			next  []embedded
+		)
+		matches := 0
+		for _, e := range level {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+
+			if i := r.ownFieldIndex(e.typ, search); i >= 0 {
+				found = append(append([]int{}, e.index...), i)
+				matches++
+			}
+
+			n := e.typ.NumField()
+			for i := 0; i < n; i++ {
+				ft := e.typ.Field(i)
+				if !ft.Anonymous || r.tagged(ft) {
+					continue
+				}
+				t := ft.Type
+				if t.Kind() == reflect.Ptr {
+					t = t.Elem()
+				}
+				if t.Kind() == reflect.Struct {
+					next = append(next, embedded{typ: t, index: append(append([]int{}, e.index...), i)})
+				}
+			}
+		}
+
+		if matches == 1 {
+			return found
+		} else if matches > 1 {
+			return nil
+		}
+		level = next
+	}
+	return nil
+}
+
+// tagged returns whether the struct field has a name given by its fieldTag or json struct tag
+func (r *reflector) tagged(ft reflect.StructField) bool {
+	return (r.fieldTag != "" && tagName(ft.Tag.Get(r.fieldTag)) != "") || tagName(ft.Tag.Get("json")) != ""
+}
+
+// fieldByIndex returns the field at the index sequence within the struct val, or an invalid Value if the field is
+// promoted through a nil embedded pointer
+func fieldByIndex(val reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				return reflect.Value{}
+			}
+			val = val.Elem()
+		}
+		val = val.Field(x)
+	}
+	return val
+}
+
+// ownFieldIndex returns the index of the struct's own field named search (case insensitive), or -1 if there is none
+// A field whose fieldTag struct tag has the name is preferred, then the field with that name, and only then one whose
+// json tag has the name, so that json tags don't change which field existing names find.
+func (r *reflector) ownFieldIndex(vt reflect.Type, search string) int {
+	byJSON, byName := -1, -1
 	n := vt.NumField()
 	for i := 0; i < n; i++ {
 		ft := vt.Field(i)
-		nom := strings.ToLower(ft.Name)
-		if nom == search {
-			f := val.Field(i)
-			if f.CanInterface() {
-				return reflective(f.Interface(), path[1:])
-			} else if len(path) == 1 {
-				return staticVal(f.Kind(), f)
-			}
-			return ""
+		if r.fieldTag != "" && tagName(ft.Tag.Get(r.fieldTag)) == search {
+			return i
+		}
+		if byJSON < 0 && tagName(ft.Tag.Get("json")) == search {
+			byJSON = i
+		}
+		if byName < 0 && strings.ToLower(ft.Name) == search {
+			byName = i
 		}
 	}
-	return ""
+
+	if byName >= 0 {
+		return byName
+	}
+	return byJSON
 }
 
-func reflectiveMap(search string, val reflect.Value, path []string) string {
+// tagName returns the lower cased name from a struct tag value, ignoring any options following a comma
+func tagName(tag string) string {
+	if i := strings.Index(tag, ","); i >= 0 {
+		tag = tag[:i]
+	}
+	return strings.ToLower(tag)
+}
+
+func (r *reflector) reflectiveMap(search string, val reflect.Value, path []string) string {
 	if search == "" {
 		if val.CanInterface() {
 			return fmt.Sprintf("%v", val.Interface())
@@ -70,23 +242,56 @@ func reflectiveMap(search string, val reflect.Value, path []string) string {
 
 	val = reflect.Indirect(val)
 
-	items := val.MapKeys()
-	for _, key := range items {
-		elem := val.MapIndex(key)
-		nom := strings.ToLower(staticVal(key.Kind(), key))
-		if nom == search {
-			if elem.CanInterface() {
-				return reflective(elem.Interface(), path[1:])
-			} else if len(path) == 1 {
-				return staticVal(elem.Kind(), elem)
-			}
-			return ""
-		}
+	elem := r.mapIndex(search, val, path[0])
+	if !elem.IsValid() {
+		return ""
+	}
+	if elem.CanInterface() {
+		return r.reflective(elem.Interface(), path[1:])
+	} else if elem = indirect(elem); len(path) == 1 && elem.IsValid() {
+		return r.staticVal(elem.Kind(), elem)
 	}
 	return ""
 }
 
-func reflective(a interface{}, path []string) string {
+// mapIndex returns the value from the map for the given key, which is looked up directly when the key can be converted
+// to the map's key type, otherwise the keys are searched for one matching (case insensitive) search
+func (r *reflector) mapIndex(search string, val reflect.Value, key string) reflect.Value {
+	kt := val.Type().Key()
+
+	var kv reflect.Value
+	switch kt.Kind() {
+	case reflect.String:
+		kv = reflect.ValueOf(key).Convert(kt)
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		if i, err := strconv.ParseInt(key, 10, kt.Bits()); err == nil {
+			kv = reflect.New(kt).Elem()
+			kv.SetInt(i)
+		}
+
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		if u, err := strconv.ParseUint(key, 10, kt.Bits()); err == nil {
+			kv = reflect.New(kt).Elem()
+			kv.SetUint(u)
+		}
+	}
+
+	if kv.IsValid() {
+		if elem := val.MapIndex(kv); elem.IsValid() {
+			return elem
+		}
+	}
+
+	for _, mk := range val.MapKeys() {
+		if strings.ToLower(r.staticVal(mk.Kind(), mk)) == search {
+			return val.MapIndex(mk)
+		}
+	}
+	return reflect.Value{}
+}
+
+func (r *reflector) reflective(a interface{}, path []string) string {
 	search := ""
 	n := len(path)
 	if n > 0 {
@@ -97,16 +302,22 @@ func reflective(a interface{}, path []string) string {
 		return fmt.Sprintf("%T", a)
 	}
 
+	if n == 0 {
+		if s, ok := formatted(a); ok {
+			return s
+		}
+	}
+
 	// Use reflection to find a field with the specific name (case insensitive)
-	val := reflect.ValueOf(a)
-	if val.Kind() == reflect.Ptr {
-		val = reflect.Indirect(val)
+	val := indirect(reflect.ValueOf(a))
+	if !val.IsValid() {
+		return ""
 	}
 
 	vk := val.Kind()
 	switch vk {
 	case reflect.Struct:
-		return reflectiveStruct(search, val, path)
+		return r.reflectiveStruct(search, val, path)
 
 	case reflect.Slice:
 		if val.IsNil() {
@@ -114,20 +325,95 @@ func reflective(a interface{}, path []string) string {
 		}
 		fallthrough
 	case reflect.Array:
-		return reflectiveArray(search, val, path)
+		return r.reflectiveArray(search, val, path)
 
 	case reflect.Map:
-		return reflectiveMap(search, val, path)
+		return r.reflectiveMap(search, val, path)
 
 	default:
 		if search != "" {
 			return ""
 		}
-		return staticVal(vk, val)
+		return r.staticVal(vk, val)
+	}
+}
+
+// indirect follows pointers and interfaces to the value they hold, returning an invalid Value if any of them are nil
+func indirect(val reflect.Value) reflect.Value {
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return reflect.Value{}
+		}
+		val = val.Elem()
+	}
+	return val
+}
+
+// reflectiveValue returns the value found at the given path within a, or nil if it can't be found
+func (r *reflector) reflectiveValue(a interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return a
+	}
+
+	search := strings.ToLower(path[0])
+	val := indirect(reflect.ValueOf(a))
+
+	var f reflect.Value
+	switch val.Kind() {
+	case reflect.Struct:
+		if index := r.fieldIndex(val.Type(), search); index != nil {
+			f = fieldByIndex(val, index)
+		}
+
+	case reflect.Slice, reflect.Array:
+		pos, err := strconv.ParseInt(search, 10, 32)
+		if err == nil && int(pos) < val.Len() {
+			f = val.Index(int(pos))
+		}
+
+	case reflect.Map:
+		f = r.mapIndex(search, val, path[0])
+	}
+
+	if !f.IsValid() || !f.CanInterface() {
+		return nil
+	}
+	return r.reflectiveValue(f.Interface(), path[1:])
+}
+
+// formatted returns the key for a value which knows how to format itself, times are formatted with sortableTime, and
+// composite values implementing encoding.TextMarshaler or fmt.Stringer use those
+// Values of basic kinds keep their standard formatting, even if they implement either interface.
+func formatted(a interface{}) (string, bool) {
+	switch v := a.(type) {
+	case time.Time:
+		return v.UTC().Format(sortableTime), true
+	case *time.Time:
+		if v == nil {
+			return "", true
+		}
+		return v.UTC().Format(sortableTime), true
+	}
+
+	val := reflect.Indirect(reflect.ValueOf(a))
+	switch val.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+	default:
+		return "", false
+	}
+
+	if m, ok := a.(encoding.TextMarshaler); ok {
+		if text, err := m.MarshalText(); err == nil {
+			return string(text), true
+		}
+	}
+	if s, ok := a.(fmt.Stringer); ok {
+		return s.String(), true
 	}
+	return "", false
 }
 
-func staticVal(vk reflect.Kind, val reflect.Value) string {
+func (r *reflector) staticVal(vk reflect.Kind, val reflect.Value) string {
 	switch vk {
 	case reflect.Bool:
 		if val.Bool() {
@@ -142,10 +428,10 @@ func staticVal(vk reflect.Kind, val reflect.Value) string {
 		return strconv.FormatUint(val.Uint(), 10)
 
 	case reflect.Float32:
-		return strconv.FormatFloat(val.Float(), 'g', 10, 32)
+		return strconv.FormatFloat(val.Float(), r.floatFormat, r.floatPrecision, 32)
 
 	case reflect.Float64:
-		return strconv.FormatFloat(val.Float(), 'g', 10, 64)
+		return strconv.FormatFloat(val.Float(), r.floatFormat, r.floatPrecision, 64)
 
 	default:
 		if val.CanInterface() {
@@ -0,0 +1,26 @@
+package memdb
+
+import "time"
+
+// ScoreFunc is a function that scores an item's worth keeping, such as by combining its recency, reads and size
+type ScoreFunc func(a interface{}, now time.Time, stats Stats) float64
+
+type scoreExpirer struct {
+	threshold float64
+	score     ScoreFunc
+}
+
+// ScoreExpirer is an Expirer that expires items whose score falls below threshold
+// This allows policies combining several signals, for example a GDSF-like score of stats.Reads / stats.Size weighted
+// by the time since stats.Accessed.
+func ScoreExpirer(threshold float64, score ScoreFunc) Expirer {
+	return &scoreExpirer{
+		threshold: threshold,
+		score:     score,
+	}
+}
+
+// IsExpired implements the necessary function for an Expirer
+func (se *scoreExpirer) IsExpired(a interface{}, now time.Time, stats Stats) bool {
+	return se.score(a, now, stats) < se.threshold
+}
@@ -7,7 +7,13 @@ import (
 	"github.com/google/btree"
 	"github.com/nedscode/memdb/persist"
 
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,29 +32,75 @@ type Store struct {
 	sync.RWMutex
 
 	backing *btree.BTree
+	degree  int
+	reserve int
+	keySep  string
 	indexes map[string]*Index
 	cIndex  *Index
 	index   map[string]map[string][]*wrap
+	uids    map[UID]*wrap
+	placed  map[interface{}]*wrap
+	uidFunc func(item interface{}) UID
 	happens chan *happening
 	used    bool
+	noUID   bool
+	strict  bool
+	fields  bool
 
 	primaryKey []string
 	reversed   bool
 	comparator Comparator
 	expirer    Expirer
+	deadlines  *deadlines
 	fielder    Fielder
+	reflector  reflector
 
 	persister persist.Persister
+	logger    persist.LogFunc
 
+	// notifiers guards the notifier slices, which are read by the event goroutine without the store's lock, as it
+	// must not wait on writers which may themselves be waiting for events to be emitted
+	notifiers       sync.RWMutex
 	insertNotifiers []NotifyFunc
 	updateNotifiers []NotifyFunc
 	removeNotifiers []NotifyFunc
 	expiryNotifiers []NotifyFunc
 	accessNotifiers []NotifyFunc
-
+	batchNotifiers  []BatchNotifyFunc
+	sizeWatches     []*sizeWatch
+	expiringHooks   []ExpiringFunc
+	onAccess        func(item interface{})
+
+	stop        chan struct{}
+	emitted     chan struct{}
+	expired     chan interface{}
+	lanes       []chan *happening
+	laneWait    sync.WaitGroup
+	closed      bool
 	tickerDelay int64
+	noAccess    int32
+	expireBatch int64
+	sequence    uint64
 }
 
+// defaultDegree is the degree of the store's btrees unless changed by SetDegree
+const defaultDegree = 2
+
+// expiredBuffer is the number of expired items ExpiredChan buffers before the store's events wait for them to be read
+const expiredBuffer = 1024
+
+// defaultKeySeparator joins the components of compound index keys unless changed by SetKeySeparator
+const defaultKeySeparator = "\000"
+
+// ErrClosed is returned when attempting to modify a store that has been closed
+var ErrClosed = errors.New("memdb: store is closed")
+
+// ErrNil is returned when attempting to put or delete a nil item, including a typed nil pointer
+var ErrNil = errors.New("memdb: nil item")
+
+// ErrConflict is returned when a put is rejected by an OnConflict handler
+var ErrConflict = errors.New("memdb: rejected by unique index conflict handler")
+
 // NewStore returns an initialized store for you to use
 func NewStore() Storer {
 	s := &Store{}
@@ -64,15 +116,39 @@ func (s *Store) Init() {
 
 	happens := make(chan *happening, 100000)
 
-	s.backing = btree.New(2)
+	if s.degree == 0 {
+		s.degree = defaultDegree
+	}
+	s.backing = btree.New(s.degree)
 	s.index = map[string]map[string][]*wrap{}
+	s.uids = map[UID]*wrap{}
+	s.reflector = defaultReflector
+	if s.keySep == "" {
+		s.keySep = defaultKeySeparator
+	}
+	s.placed = map[interface{}]*wrap{}
 	s.indexes = map[string]*Index{}
 	s.happens = happens
 
+	stop := make(chan struct{})
+	emitted := make(chan struct{})
+	s.stop = stop
+	s.emitted = emitted
+
 	go func() {
+		defer close(emitted)
 		for h := range happens {
-			s.emit(h.event, h.old, h.new, h.stats)
+			if s.lanes != nil {
+				s.lanes[h.lane()] <- h
+				continue
+			}
+			s.deliver(h)
+		}
+
+		for _, lane := range s.lanes {
+			close(lane)
 		}
+		s.laneWait.Wait()
 	}()
 
 	// About 2.6 times per minute, shouldn't hit the same time every minute
@@ -80,17 +156,48 @@ func (s *Store) Init() {
 
 	go func() {
 		// Give initial callers time to call ExpireInterval before we start the first tick
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-stop:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
 
 		for {
 			delayTime := atomic.LoadInt64(&s.tickerDelay)
-			time.Sleep(time.Duration(delayTime))
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(delayTime)):
+			}
 
 			s.Expire()
 		}
 	}()
 }
 
+// Close stops the store's background expiry and, once all pending events have been emitted, its event goroutine
+// After Close, operations which return an error (Put, PutAll, Delete, GetOrPut and the like) return ErrClosed, and reads
+// panic with a message saying the store is closed.
+// Event handlers still being called as the events drain must not use the store.
+func (s *Store) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	close(s.stop)
+	close(s.happens)
+	expired := s.expired
+	s.Unlock()
+
+	<-s.emitted
+	if expired != nil {
+		close(expired)
+	}
+	return nil
+}
+
 // Less is a comparator function that checks if one item is less than another
 func (s *Store) Less(a interface{}, b interface{}) bool {
 	less := func() bool {
@@ -105,8 +212,8 @@ func (s *Store) Less(a interface{}, b interface{}) bool {
 		}
 
 		if len(s.primaryKey) > 0 {
-			aid := s.getFieldsValue(a, s.primaryKey)
-			bid := s.getFieldsValue(b, s.primaryKey)
+			aid := s.primaryValue(a)
+			bid := s.primaryValue(b)
 			return aid < bid
 		}
 
@@ -145,33 +252,109 @@ func (s *Store) GetField(a interface{}, field string) string {
 	}
 
 	path := strings.Split(field, ".")
-	return reflective(a, path)
+	return s.reflector.reflective(a, path)
 }
 
 // SetIndexer sets the comparator, expirer and fielder for this store
-// If you override the default comparator, the Store's primary key will no longer determine item ordering
+// If you override the default comparator, the Store's primary key will no longer determine item ordering. See
+// SetComparator and SetFielder for the effect on a populated store.
 func (s *Store) SetIndexer(indexer Indexer) {
+	s.Lock()
+	defer s.Unlock()
+
 	s.comparator = indexer
 	s.expirer = indexer
 	s.fielder = indexer
+	s.trackDeadlines()
 }
 
 // SetComparator sets just the comparator for this store
 // If you override the default comparator, the Store's primary key will no longer determine item ordering
+// Setting it is safe while the store is in use, but the existing items are not reordered, so changing the ordering of a
+// populated store corrupts it. Use SetComparatorReindex to change the ordering of a populated store.
 func (s *Store) SetComparator(comparator Comparator) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.comparator = comparator
+}
+
+// SetComparatorReindex sets just the comparator for this store and rebuilds the store's ordering with it
+// Any existing items that are deemed equal by the new comparator will collapse into one, the earlier ordered items
+// being removed from the store (with a Remove event).
+func (s *Store) SetComparatorReindex(comparator Comparator) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.mustBeOpen()
 	s.comparator = comparator
+
+	var wraps []*wrap
+	s.backing.Ascend(func(item btree.Item) bool {
+		if w, ok := item.(*wrap); ok {
+			wraps = append(wraps, w)
+		}
+		return true
+	})
+
+	s.backing = btree.New(s.degree)
+	for _, w := range wraps {
+		found := s.backing.ReplaceOrInsert(w)
+		if found == nil {
+			continue
+		}
+
+		ow := found.(*wrap)
+		delete(s.uids, ow.uid)
+		s.unplace(ow)
+		s.dropDeadlines(ow)
+		for _, index := range s.indexes {
+			s.unindexWrap(index, ow)
+		}
+		if s.persister != nil {
+			if err := s.persister.Remove(string(ow.uid)); err != nil {
+				s.log("warn", "unable to remove collapsed item", "item", ow.item, "error", err)
+			}
+		}
+		s.notify(Remove, ow.item, nil, ow.stats.copy())
+	}
 }
 
 // SetExpirer sets just the expirer for this store
+// When given an AgeExpirer without any ExpireFuncs, the store tracks when each item could next expire so that Expire
+// only examines items which are due, rather than scanning the entire store.
+// The expirer may be changed while the store is in use, e.g. to adjust ages to the load on the store, and is used from
+// the next Expire.
 func (s *Store) SetExpirer(expirer Expirer) {
+	s.Lock()
+	defer s.Unlock()
+
 	s.expirer = expirer
+	s.trackDeadlines()
 }
 
 // SetFielder sets just the fielder for this store
+// Setting it is safe while the store is in use, but existing items keep the index keys they were given by the previous
+// fielder until they are put again.
 func (s *Store) SetFielder(fielder Fielder) {
+	s.Lock()
+	defer s.Unlock()
+
 	s.fielder = fielder
 }
 
+// SetLogger sets a function to receive warnings about otherwise silent conditions within the store and its persister
+// By default warnings are discarded.
+func (s *Store) SetLogger(logger persist.LogFunc) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.logger = logger
+	if loggable, ok := s.persister.(persist.Loggable); ok {
+		loggable.SetLogger(logger)
+	}
+}
+
 // PrimaryKey sets the primary key for this store, will not work if a custom comparator is being used
 func (s *Store) PrimaryKey(fields ...string) *Store {
 	if s.used {
@@ -184,6 +367,141 @@ func (s *Store) PrimaryKey(fields ...string) *Store {
 	return s
 }
 
+// NoUID disables the generation of UIDs for items in the store, saving the cost of generating them on every Put
+// UIDs are still generated if the store is made Persistent, as persisters require them. Without UIDs, InfoIterators
+// receive an empty UID, UID reports items as not found and GetByUID returns nil.
+func (s *Store) NoUID() *Store {
+	if s.used {
+		panic("Cannot disable UIDs on in-use store")
+	}
+
+	s.noUID = true
+	return s
+}
+
+// SetUIDFunc sets a function to derive the UID of items from the items themselves, rather than generating them
+// This allows natural IDs to be used as UIDs, so that persisted items are identifiable and re-putting an item
+// overwrites its previously persisted copy. Put returns an error if fn returns an empty UID, or a UID that is already
+// used by a different item in the store. Items keep their UID when Replaced.
+func (s *Store) SetUIDFunc(fn func(item interface{}) UID) *Store {
+	if s.used {
+		panic("Cannot set UID func on in-use store")
+	}
+
+	s.uidFunc = fn
+	return s
+}
+
+// StrictKeys sets whether Put checks that a previously stored item has not had its primary key changed
+// When enabled, re-putting an item whose primary key fields have been modified since it was stored (which would leave
+// it stranded in the wrong location in the store) will return an error instead of corrupting the store. Only items of
+// comparable types (eg: pointers) can be checked.
+func (s *Store) StrictKeys(strict bool) *Store {
+	if s.used {
+		panic("Cannot change strict keys on in-use store")
+	}
+
+	s.strict = strict
+	return s
+}
+
+// StrictFields sets whether Put checks that each of the item's indexed fields resolves via reflection
+// When enabled, putting an item for which any field of an index resolves to an empty value returns an error naming
+// the field, catching mistyped field names at write time. Computed indexes, partial indexes the item is excluded from,
+// and stores or items which provide their own Fielder are not checked.
+func (s *Store) StrictFields(strict bool) *Store {
+	if s.used {
+		panic("Cannot change strict fields on in-use store")
+	}
+
+	s.fields = strict
+	return s
+}
+
+// SetDegree sets the degree of the btrees used for the store and its index keys, the default is 2
+// Higher degrees produce shallower trees with better cache behaviour, a degree of 32 to 64 is sensible for stores
+// holding hundreds of thousands of items or more. Must be called before any indexes are created.
+func (s *Store) SetDegree(degree int) *Store {
+	if s.used {
+		panic("Cannot change degree on in-use store")
+	}
+	if len(s.indexes) > 0 {
+		panic("Cannot change degree after creating indexes")
+	}
+	if degree < 2 {
+		panic("Degree must be at least 2")
+	}
+
+	s.degree = degree
+	s.backing = btree.New(degree)
+	return s
+}
+
+// SetKeySeparator sets the separator used to join the components of compound index keys, the default is "\000"
+// Field values containing the separator make keys ambiguous, so merge items into the wrong keys, choose a separator
+// which cannot appear in the indexed values. Keys returned by Keys, Distinct and similar are joined by the separator.
+func (s *Store) SetKeySeparator(sep string) *Store {
+	if s.used {
+		panic("Cannot change key separator on in-use store")
+	}
+	if sep == "" {
+		panic("Key separator must not be empty")
+	}
+
+	s.keySep = sep
+	return s
+}
+
+// Reserve pre-sizes the store's index and UID maps for n items, avoiding repeated growth of the maps when bulk loading
+// a known number of items
+// Index maps are sized for n distinct keys, so for indexes with few distinct keys this reserves more memory than is
+// needed. Must be called before the store is used (including being made Persistent).
+func (s *Store) Reserve(n int) *Store {
+	if s.used {
+		panic("Cannot reserve on in-use store")
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	s.reserve = n
+	s.uids = make(map[UID]*wrap, n)
+	if s.strict {
+		s.placed = make(map[interface{}]*wrap, n)
+	}
+	for id := range s.indexes {
+		s.index[id] = make(map[string][]*wrap, n)
+	}
+	return s
+}
+
+// SetFloatFormat sets the format and precision used when formatting float fields into index keys via reflection
+// The format and precision are as per strconv.FormatFloat, the default is 'g' with a precision of 10, which can cause
+// distinct values to share the same key. Use a precision of -1 to get the smallest representation which uniquely
+// identifies each value.
+func (s *Store) SetFloatFormat(format byte, precision int) *Store {
+	if s.used {
+		panic("Cannot change float format on in-use store")
+	}
+
+	s.reflector.floatFormat = format
+	s.reflector.floatPrecision = precision
+	return s
+}
+
+// SetFieldTag sets the struct tag consulted when finding fields by name via reflection, the default is "memdb"
+// A field whose tag has the requested name is preferred, then the field with that name, falling back to a field whose
+// json tag has the name. Set an empty tag to only consult json tags.
+func (s *Store) SetFieldTag(tag string) *Store {
+	if s.used {
+		panic("Cannot change field tag on in-use store")
+	}
+
+	s.reflector.fieldTag = tag
+	s.reflector.fields = &sync.Map{}
+	return s
+}
+
 // Reversed flips the meaning of the comparator
 // Can supply an optional boolean value to set reversal order, or if unspecified, sets to true
 // Effectively this swaps the insert order of the store, so that less items are stored after greater items
@@ -207,16 +525,55 @@ func (s *Store) CreateIndex(fields ...string) *Store {
 		panic("Cannot create index on in-use store")
 	}
 
+	s.addIndex(fields, nil)
+	return s
+}
+
+// CreateComputedIndex adds a new index named name, keyed by the result of calling fn with each item
+// This allows indexing by derived values, eg: the first letter of a field, or a number bucketed into ranges.
+// Lookups are performed by passing the computed key, eg: store.In(name).Lookup(computedKey)
+func (s *Store) CreateComputedIndex(name string, fn func(item interface{}) string) *Store {
+	if s.used {
+		panic("Cannot create index on in-use store")
+	}
+
+	s.addIndex([]string{name}, fn)
+	return s
+}
+
+// CreateIndexByJSON adds a new index named name, keyed by the canonical JSON encoding of the value found at path
+// This allows grouping of items by the equality of a whole sub-object rather than a single scalar field. Lookups are
+// performed by passing the canonical JSON, eg: store.In(name).Lookup(`{"a":1,"b":"two"}`)
+// Items with no value at path, a null value, or a value that cannot be marshalled to JSON are indexed with an empty key,
+// as for a missing field in other indexes, rather than the JSON "null".
+func (s *Store) CreateIndexByJSON(name string, path string) *Store {
+	if s.used {
+		panic("Cannot create index on in-use store")
+	}
+
+	split := strings.Split(path, ".")
+	s.addIndex([]string{name}, func(a interface{}) string {
+		data, err := json.Marshal(s.reflector.reflectiveValue(a, split))
+		if err != nil || string(data) == "null" {
+			return ""
+		}
+		return string(data)
+	})
+	return s
+}
+
+func (s *Store) addIndex(fields []string, compute func(a interface{}) string) {
 	id := strings.Join(fields, "\000")
 	index := &Index{
-		n:      len(s.indexes),
-		id:     id,
-		fields: fields,
-		store:  s,
+		n:       len(s.indexes),
+		id:      id,
+		fields:  fields,
+		store:   s,
+		compute: compute,
+		keys:    btree.New(s.degree),
 	}
 	s.indexes[id] = index
 	s.cIndex = index
-	return s
 }
 
 // Unique makes the current index unique
@@ -231,19 +588,86 @@ func (s *Store) Unique() *Store {
 	return s
 }
 
+// Where makes the current index partial, only items for which predicate returns true will be held in the index
+// Items not matching the predicate are still stored, and held in any other indexes they qualify for.
+func (s *Store) Where(predicate func(item interface{}) bool) *Store {
+	if s.used {
+		panic("Cannot create index on in-use store")
+	}
+	if s.cIndex != nil {
+		s.cIndex.where = predicate
+	}
+	return s
+}
+
+// Numeric makes the current index encode numeric field values in its keys so that their ordering matches numeric order,
+// allowing meaningful IndexRange scans over numbers
+// Keys are encoded as 16 hex digits from the value as a float64, negative values ordering before positive ones, so
+// integers beyond +/-2^53 lose precision. Non-numeric values are kept as is. Keys passed to lookups are encoded in the
+// same way, so continue to be given as plain numbers.
+func (s *Store) Numeric() *Store {
+	if s.used {
+		panic("Cannot create index on in-use store")
+	}
+	if s.cIndex != nil {
+		s.cIndex.numeric = true
+	}
+	return s
+}
+
+// Ordered makes the current index keep the items in each of its keys in the order they were put, which LookupOrdered
+// returns them in
+// Removing an item from an ordered index shifts the items after it, rather than moving the last item into its place,
+// so is O(items in the key). Updating an item moves it to the end of its keys.
+func (s *Store) Ordered() *Store {
+	if s.used {
+		panic("Cannot create index on in-use store")
+	}
+	if s.cIndex != nil {
+		s.cIndex.ordered = true
+	}
+	return s
+}
+
+// CapBucket limits each key of the current index to holding n items, when a Put takes a key over the limit the oldest
+// items in that key are expired (with an Expiry event) to bring it back to n
+// Items are ordered by by, which may be one of the stats "Created" (the default if empty), "Modified" or "Accessed",
+// otherwise it is the name of a field of the item, whose values are compared numerically where possible. The item being
+// put is never expired, even if it orders before the items already in the key, and nor are pinned items, so a key
+// whose other items are all pinned may be left over the limit.
+func (s *Store) CapBucket(n int, by string) *Store {
+	if s.used {
+		panic("Cannot create index on in-use store")
+	}
+	if s.cIndex != nil {
+		s.cIndex.capN = n
+		s.cIndex.capBy = by
+	}
+	return s
+}
+
 // Persistent adds a persister to the database and loads up the existing records, call after all indexes are setup but
 // before you begin using it.
+// Persisters may return a *persist.LoadError to report how many items failed to load, the successfully loaded items
+// are still added to the store.
 func (s *Store) Persistent(persister persist.Persister) error {
 	if s.used {
 		panic("Cannot make persist on in-use store")
 	}
 
-	s.used = true
-	s.persister = persister
-
 	s.Lock()
 	defer s.Unlock()
 
+	if s.closed {
+		return ErrClosed
+	}
+
+	s.used = true
+	s.persister = persister
+	if loggable, ok := persister.(persist.Loggable); ok && s.logger != nil {
+		loggable.SetLogger(s.logger)
+	}
+
 	var err error
 	if metaPersister, ok := persister.(persist.MetaPersister); ok {
 		err = metaPersister.MetaLoad(func(id string, item interface{}, meta *persist.Meta) {
@@ -263,11 +687,61 @@ func (s *Store) Persistent(persister persist.Persister) error {
 	return err
 }
 
-// Get returns an item equal to the passed item from the store
-func (s *Store) Get(search interface{}) interface{} {
+// IsPersistent returns whether the store has a persister
+func (s *Store) IsPersistent() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.persister != nil
+}
+
+// PersisterKind returns the type name of the store's persister, or "" if the store is not persistent
+func (s *Store) PersisterKind() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.persister == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", s.persister)
+}
+
+// MetaEnabled returns whether the store's persister is a persist.MetaPersister, which is required for the Size of
+// items to be known in IndexStats and StoreStats
+func (s *Store) MetaEnabled() bool {
 	s.RLock()
 	defer s.RUnlock()
 
+	_, ok := s.persister.(persist.MetaPersister)
+	return ok
+}
+
+// Get returns an item equal to the passed item from the store, nil search items (including typed nil pointers) are
+// never found
+func (s *Store) Get(search interface{}) interface{} {
+	s.rlockOpen()
+	item := s.get(search)
+	onAccess := s.onAccess
+	s.RUnlock()
+
+	if onAccess != nil && item != nil {
+		onAccess(item)
+	}
+	return item
+}
+
+func (s *Store) get(search interface{}) interface{} {
+	if w := s.getWrap(search); w != nil {
+		return w.item
+	}
+	return nil
+}
+
+// getWrap returns the wrap equal to the search item and records a read of it, must be called with the store's lock held
+func (s *Store) getWrap(search interface{}) *wrap {
+	if isNil(search) {
+		return nil
+	}
 	found := s.backing.Get(&wrap{
 		storer: s,
 		item:   search,
@@ -277,74 +751,403 @@ func (s *Store) Get(search interface{}) interface{} {
 	}
 
 	if w, ok := found.(*wrap); ok {
-		w.stats.read(time.Now())
-		s.happens <- &happening{
-			event: Access,
-			old:   w.item,
-			new:   w.item,
-			stats: w.stats,
-		}
+		s.access(w, time.Now())
 
-		return w.item
+		return w
 	}
 
 	return nil
 }
 
-// InPrimaryKey finds a the primary key index to perform queries upon
-func (s *Store) InPrimaryKey() IndexSearcher {
-	return s.In(s.primaryKey...)
-}
-
-// In finds a simple or compound index to perform queries upon
-func (s *Store) In(fields ...string) IndexSearcher {
+// Contains returns whether an item equal to the passed item exists in the store
+// Unlike Get, this does not record a read of the item or emit an Access event.
+func (s *Store) Contains(search interface{}) bool {
 	s.RLock()
 	defer s.RUnlock()
 
-	id := strings.Join(fields, "\000")
-	if f, ok := s.indexes[id]; ok {
-		return f
-	}
+	return s.contains(search)
+}
 
-	var idx *Index
-	return idx
+func (s *Store) contains(search interface{}) bool {
+	if isNil(search) {
+		return false
+	}
+	return s.backing.Has(&wrap{
+		storer: s,
+		item:   search,
+	})
 }
 
-// Info calls provided callback function from start (lowest order) of items until end or iterator function returns
-// false, includes statistical information for all items in callback.
-func (s *Store) Info(cb InfoIterator) {
-	s.RLock()
-	defer s.RUnlock()
-	traverse(s.backing.AscendRange, nil, nil, s.cbWrap(cb))
+// GetWithStats returns an item equal to the passed item from the store, along with a copy of its stats and whether it
+// was found
+// As with Get, the read is recorded and any OnAccess hook is called, and nil search items are never found.
+func (s *Store) GetWithStats(search interface{}) (interface{}, Stats, bool) {
+	s.rlockOpen()
+	w := s.getWrap(search)
+	var item interface{}
+	var stats Stats
+	if w != nil {
+		item, stats = w.item, w.stats.copy()
+	}
+	onAccess := s.onAccess
+	s.RUnlock()
+
+	if onAccess != nil && item != nil {
+		onAccess(item)
+	}
+	return item, stats, item != nil
 }
 
-// Ascend calls provided callback function from start (lowest order) of items until end or iterator function returns
-// false
-func (s *Store) Ascend(cb Iterator) {
-	s.RLock()
-	defer s.RUnlock()
-	traverse(s.backing.AscendRange, nil, nil, s.cbWrap(cb))
+// Pin exempts the item equal to the passed item from expiry until it is unpinned, returns whether the item was found
+// The pinned state is kept when the item is updated via Put.
+func (s *Store) Pin(search interface{}) bool {
+	return s.setPinned(search, true)
 }
 
-// AscendStarting calls provided callback function from item equal to at until end or iterator function returns false
-func (s *Store) AscendStarting(at interface{}, cb Iterator) {
-	s.RLock()
-	defer s.RUnlock()
-	traverse(s.backing.AscendRange, &wrap{storer: s, item: at}, nil, s.cbWrap(cb))
+// Unpin makes a pinned item equal to the passed item eligible for expiry again, returns whether the item was found
+func (s *Store) Unpin(search interface{}) bool {
+	return s.setPinned(search, false)
 }
 
-// Descend calls provided callback function from end (highest order) of items until start or iterator function returns
-// false
-func (s *Store) Descend(cb Iterator) {
+func (s *Store) setPinned(search interface{}, pinned bool) bool {
 	s.RLock()
 	defer s.RUnlock()
-	traverse(s.backing.DescendRange, nil, nil, s.cbWrap(cb))
-}
 
-// DescendStarting calls provided callback function from item equal to at until start or iterator function returns false
-func (s *Store) DescendStarting(at interface{}, cb Iterator) {
+	found := s.backing.Get(&wrap{
+		storer: s,
+		item:   search,
+	})
+	if w, ok := found.(*wrap); ok {
+		w.stats.pin(pinned)
+		return true
+	}
+	return false
+}
+
+// ItemInfo contains everything the store knows about a stored item, as returned by Inspect
+type ItemInfo struct {
+	UID   UID
+	Item  interface{}
+	Stats Stats
+
+	// Keys holds the keys the item is held under in each index, keyed by index id (the index's fields joined by
+	// "\000"), indexes the item is not held in are omitted
+	Keys map[string][]FieldKey
+}
+
+// Inspect returns the internal state of the item equal to the passed item, and whether it was found
+// It is intended for diagnostics, so does not count as an access of the item.
+func (s *Store) Inspect(search interface{}) (*ItemInfo, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	found := s.backing.Get(&wrap{
+		storer: s,
+		item:   search,
+	})
+	w, ok := found.(*wrap)
+	if !ok {
+		return nil, false
+	}
+
+	info := &ItemInfo{
+		UID:   w.uid,
+		Item:  w.item,
+		Stats: w.stats.copy(),
+		Keys:  map[string][]FieldKey{},
+	}
+	for id, index := range s.indexes {
+		for _, key := range w.values[index.n] {
+			info.Keys[id] = append(info.Keys[id], FieldKey(s.splitKey(key)))
+		}
+	}
+	return info, true
+}
+
+// keySearch is a search item for GetByKey, holding the components of a primary key
+type keySearch []string
+
+// primaryValue returns the primary key value of the item, or of a keySearch
+func (s *Store) primaryValue(a interface{}) string {
+	if keys, ok := a.(keySearch); ok {
+		return s.joinKey(keys)
+	}
+	return s.getFieldsValue(a, s.primaryKey)
+}
+
+// GetByKey returns the item whose primary key is given by keys from the store, without needing an item to search with
+// It requires the store to have a PrimaryKey and no custom Comparator, and returns nil otherwise. If the items are
+// Indexable, their Less must order them by the primary key.
+func (s *Store) GetByKey(keys ...string) interface{} {
+	s.rlockOpen()
+	if len(s.primaryKey) == 0 || s.comparator != nil || len(keys) != len(s.primaryKey) {
+		s.RUnlock()
+		return nil
+	}
+	item := s.get(keySearch(keys))
+	onAccess := s.onAccess
+	s.RUnlock()
+
+	if onAccess != nil && item != nil {
+		onAccess(item)
+	}
+	return item
+}
+
+// GetByUID returns the item with the given UID from the store
+// Stores with UIDs disabled by NoUID never find an item.
+func (s *Store) GetByUID(uid UID) interface{} {
+	s.rlockOpen()
+	defer s.RUnlock()
+
+	if !s.hasUIDs() {
+		return nil
+	}
+
+	w, ok := s.uids[uid]
+	if !ok {
+		return nil
+	}
+
+	s.access(w, time.Now())
+
+	return w.item
+}
+
+// UID returns the UID of the stored item equal to the passed item, and whether it was found
+// This is the same UID that is supplied to the persister when saving the item. Stores with UIDs disabled by NoUID
+// report every item as not found.
+func (s *Store) UID(search interface{}) (UID, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if !s.hasUIDs() {
+		return "", false
+	}
+
+	found := s.backing.Get(&wrap{
+		storer: s,
+		item:   search,
+	})
+	if found == nil {
+		return "", false
+	}
+
+	if w, ok := found.(*wrap); ok {
+		return w.uid, true
+	}
+	return "", false
+}
+
+// InPrimaryKey finds a the primary key index to perform queries upon
+func (s *Store) InPrimaryKey() IndexSearcher {
+	return s.In(s.primaryKey...)
+}
+
+// In finds a simple or compound index to perform queries upon
+func (s *Store) In(fields ...string) IndexSearcher {
+	s.RLock()
+	defer s.RUnlock()
+
+	id := strings.Join(fields, "\000")
+	if f, ok := s.indexes[id]; ok {
+		return f
+	}
+
+	var idx *Index
+	return idx
+}
+
+// IndexByID finds an index by its id (the index's fields joined by "\000") to perform queries upon
+func (s *Store) IndexByID(id string) IndexSearcher {
+	s.RLock()
+	defer s.RUnlock()
+
+	if f, ok := s.indexes[id]; ok {
+		return f
+	}
+
+	var idx *Index
+	return idx
+}
+
+// IndexIDs returns the sorted ids of all indexes in the store, splitting an id by "\000" gives the index's fields
+func (s *Store) IndexIDs() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	ids := make([]string, 0, len(s.indexes))
+	for id := range s.indexes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Info calls provided callback function from start (lowest order) of items until end or iterator function returns
+// false, includes statistical information for all items in callback.
+func (s *Store) Info(cb InfoIterator) {
+	s.rlockOpen()
+	defer s.RUnlock()
+	traverse(s.backing.AscendRange, nil, nil, s.cbWrap(cb))
+}
+
+// ModifiedSince returns all items which have been modified after the given time.
+// As the store is not ordered by modification time, this performs a full traversal of the store and is O(n), if you
+// need to perform this frequently on a large store, consider maintaining your own modified-time ordered view.
+func (s *Store) ModifiedSince(t time.Time) []interface{} {
+	var items []interface{}
+	s.Info(func(_ UID, item interface{}, stats Stats) bool {
+		if stats.Modified.After(t) {
+			items = append(items, item)
+		}
+		return true
+	})
+	return items
+}
+
+// EachModifiedSince calls provided callback function, in order, for each item which has been modified after the given
+// time until end or iterator function returns false, includes statistical information for the items in callback
+// As the store is not ordered by modification time, this performs a full traversal of the store and is O(n). Unlike
+// Info, visiting the items does not count as an access of them. The store's read lock is held while the callback is
+// called, so the callback MUST NOT modify the store.
+func (s *Store) EachModifiedSince(t time.Time, cb InfoIterator) {
 	s.RLock()
 	defer s.RUnlock()
+
+	s.backing.Ascend(func(item btree.Item) bool {
+		w, ok := item.(*wrap)
+		if !ok {
+			return true
+		}
+
+		stats := w.stats.copy()
+		if !stats.Modified.After(t) {
+			return true
+		}
+		return cb(w.uid, w.item, stats)
+	})
+}
+
+// First returns the first (lowest order) item in the store, the same item Ascend would start from, or nil if the store
+// is empty
+func (s *Store) First() interface{} {
+	s.rlockOpen()
+	defer s.RUnlock()
+
+	return s.edge(s.backing.Min())
+}
+
+// Last returns the last (highest order) item in the store, the same item Descend would start from, or nil if the store
+// is empty
+func (s *Store) Last() interface{} {
+	s.rlockOpen()
+	defer s.RUnlock()
+
+	return s.edge(s.backing.Max())
+}
+
+func (s *Store) edge(found btree.Item) interface{} {
+	if w, ok := found.(*wrap); ok {
+		s.access(w, time.Now())
+		return w.item
+	}
+	return nil
+}
+
+// Ascend calls provided callback function from start (lowest order) of items until end or iterator function returns
+// false
+func (s *Store) Ascend(cb Iterator) {
+	s.rlockOpen()
+	defer s.RUnlock()
+	traverse(s.backing.AscendRange, nil, nil, s.cbWrap(cb))
+}
+
+// AscendStarting calls provided callback function from item equal to at until end or iterator function returns false
+func (s *Store) AscendStarting(at interface{}, cb Iterator) {
+	s.rlockOpen()
+	defer s.RUnlock()
+	traverse(s.backing.AscendRange, &wrap{storer: s, item: at}, nil, s.cbWrap(cb))
+}
+
+// Cursor is a position in the store returned by AscendFrom, from which a later call continues
+// It holds the primary key of the last item returned, as a FieldKey string, so may be handed to clients and passed
+// back in a later request. The empty Cursor is the start of the store.
+type Cursor string
+
+// AscendFrom returns up to limit items (or all of them if limit is 0) in ascending order from after the item at
+// cursor, and a Cursor to continue from after the last item returned
+// No lock is held between calls, so items put or deleted in between are included or missed according to where they
+// fall relative to the cursor. Once there are no more items the returned Cursor is empty, which would start again from
+// the beginning. It requires the store to have a PrimaryKey and no custom Comparator. If the items are Indexable, their
+// Less must order them by the primary key.
+func (s *Store) AscendFrom(cursor Cursor, limit int) ([]interface{}, Cursor) {
+	s.rlockOpen()
+	defer s.RUnlock()
+
+	if len(s.primaryKey) == 0 || s.comparator != nil {
+		panic("Cannot page by cursor on a store without a primary key or with a custom comparator")
+	}
+
+	var (
+		from  btree.Item
+		after string
+		items []interface{}
+		more  bool
+	)
+	if cursor != "" {
+		keys := keySearch(NewFieldKey(string(cursor)))
+		from = &wrap{storer: s, item: keys}
+		after = s.primaryValue(keys)
+	}
+
+	collect := s.cbWrap(Iterator(func(item interface{}) bool {
+		items = append(items, item)
+		return true
+	}))
+	traverse(s.backing.AscendRange, from, nil, func(i btree.Item) bool {
+		if w, ok := i.(*wrap); ok && from != nil && s.primaryValue(w.item) == after {
+			return true
+		}
+		if limit > 0 && len(items) == limit {
+			more = true
+			return false
+		}
+		collect(i)
+		return true
+	})
+
+	if !more || len(items) == 0 {
+		return items, ""
+	}
+	last := items[len(items)-1]
+	return items, Cursor(FieldKey(s.splitKey(s.primaryValue(last))).String())
+}
+
+// Descend calls provided callback function from end (highest order) of items until start or iterator function returns
+// false
+func (s *Store) Descend(cb Iterator) {
+	s.rlockOpen()
+	defer s.RUnlock()
+	traverse(s.backing.DescendRange, nil, nil, s.cbWrap(cb))
+}
+
+// AscendContext is like Ascend, but also stops once ctx is done, which is checked periodically during the traversal
+// Stopping due to cancellation is not an error, check ctx.Err() if you need to know whether the traversal completed.
+func (s *Store) AscendContext(ctx context.Context, cb Iterator) {
+	s.Ascend(contextIterator(ctx, cb))
+}
+
+// DescendContext is like Descend, but also stops once ctx is done, which is checked periodically during the traversal
+// Stopping due to cancellation is not an error, check ctx.Err() if you need to know whether the traversal completed.
+func (s *Store) DescendContext(ctx context.Context, cb Iterator) {
+	s.Descend(contextIterator(ctx, cb))
+}
+
+// DescendStarting calls provided callback function from item equal to at until start or iterator function returns false
+func (s *Store) DescendStarting(at interface{}, cb Iterator) {
+	s.rlockOpen()
+	defer s.RUnlock()
 	traverse(s.backing.DescendRange, &wrap{storer: s, item: at}, nil, s.cbWrap(cb))
 }
 
@@ -353,233 +1156,1464 @@ func (s *Store) ExpireInterval(interval time.Duration) {
 	atomic.StoreInt64(&s.tickerDelay, int64(interval))
 }
 
-// Expire finds all expiring items in the store and deletes them
+// ExpireBatchSize limits the number of items a single Expire pass will remove, 0 (the default) means no limit
+// Items left over once the limit is reached remain due and will be removed by subsequent passes, spreading the cost of
+// a mass expiry across ticks. Use Due to find how many items are left after a pass.
+func (s *Store) ExpireBatchSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&s.expireBatch, int64(n))
+}
+
+// Due returns the number of items which have expired and are waiting to be removed by Expire
+// OnExpiring hooks are not consulted, so items they would keep are included in the count.
+func (s *Store) Due() int {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return 0
+	}
+
+	due := s.findExpired(time.Now(), 0)
+	// Finding the items took them off the deadline heap, they remain due
+	s.requeue(due)
+	return len(due)
+}
+
+// Expire finds all expiring items in the store and deletes them, returns the number of items removed
+// If an ExpireBatchSize has been set, at most that many items will be removed per call. The store's lock is held while
+// the Expirer is consulted, so Expirers MUST NOT call the store's methods.
 func (s *Store) Expire() int {
-	rm := s.findExpired()
+	return s.expireN(0, int(atomic.LoadInt64(&s.expireBatch)))
+}
+
+// ExpireN removes at most max expired items from the store, returns the number of items removed
+// The scan for expired items stops as soon as max candidates have been found, so this avoids a full traversal when
+// only a few items are needed. Items kept by an OnExpiring hook count towards max.
+func (s *Store) ExpireN(max int) int {
+	if max <= 0 {
+		return 0
+	}
 
+	return s.expireN(max, 0)
+}
+
+// expireN finds up to limit expired items and removes up to batch of them (either may be 0 for no limit)
+// The items are found and removed under a single acquisition of the store's lock, so cannot be replaced or removed by
+// another goroutine in between. The lock is only released to call any OnExpiring hooks, after which each item is
+// checked again before it is removed.
+func (s *Store) expireN(limit, batch int) int {
 	s.Lock()
 	defer s.Unlock()
 
+	if s.closed {
+		return 0
+	}
+
+	rm := s.findExpired(time.Now(), limit)
+	if len(rm) > 0 && len(s.expiringHooks) > 0 {
+		s.Unlock()
+		var vetoed []*wrap
+		rm, vetoed = s.vetoExpiring(rm)
+		s.Lock()
+
+		if s.closed {
+			return 0
+		}
+		s.requeue(s.stillStored(vetoed))
+		rm = s.stillExpired(rm)
+	}
+
+	if batch > 0 && len(rm) > batch {
+		s.requeue(rm[batch:])
+		rm = rm[:batch]
+	}
+	return s.expire(rm)
+}
+
+// stillExpired returns the wraps which are still stored and expired, requeueing any which are stored but no longer
+// expired
+func (s *Store) stillExpired(rm []*wrap) []*wrap {
+	now := time.Now()
+	var keep, expired []*wrap
+	for _, w := range rm {
+		if found := s.backing.Get(w); found != btree.Item(w) {
+			// Replaced or removed while the lock was released
+			continue
+		}
+
+		w.RLock()
+		if w.expirable(now) && s.IsExpired(w.item, now, w.stats) {
+			expired = append(expired, w)
+		} else {
+			keep = append(keep, w)
+		}
+		w.RUnlock()
+	}
+
+	s.requeue(keep)
+	return expired
+}
+
+// expire removes the expired wraps, must be called with the store's lock held
+func (s *Store) expire(rm []*wrap) int {
+	now := time.Now()
 	for _, wrapped := range rm {
 		old, _ := s.rm(wrapped)
 		if old != nil {
-			s.happens <- &happening{
-				event: Expiry,
-				old:   old.item,
-				stats: old.stats,
-			}
+			stats := old.stats.copy()
+			stats.Reason = s.expiryReason(old.item, now, stats)
+			s.notify(Expiry, old.item, nil, stats)
 		}
 	}
+	s.checkSize()
 
 	return len(rm)
 }
 
+// expiryReason returns why the store's expirer found the item to be expired
+func (s *Store) expiryReason(a interface{}, now time.Time, stats Stats) ExpiryReason {
+	if reasoner, ok := s.expirer.(ExpiryReasoner); ok {
+		if reason := reasoner.ExpiryReason(a, now, stats); reason != NotExpired {
+			return reason
+		}
+	}
+	return AgeExpired
+}
+
+// Clear removes all items from the store, keeping its indexes and configuration
+// If the store is persistent, the persister is truncated if it implements persist.Truncater, otherwise each item is
+// removed from it individually. No events are emitted for the removed items.
+func (s *Store) Clear() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	var err error
+	if truncater, ok := s.persister.(persist.Truncater); ok {
+		err = truncater.Truncate()
+	} else if s.persister != nil {
+		s.backing.Ascend(func(item btree.Item) bool {
+			if w, ok := item.(*wrap); ok {
+				if rmErr := s.persister.Remove(string(w.UID())); rmErr != nil {
+					err = rmErr
+				}
+			}
+			return true
+		})
+	}
+
+	s.backing = btree.New(s.degree)
+	s.index = map[string]map[string][]*wrap{}
+	s.uids = map[UID]*wrap{}
+	s.placed = map[interface{}]*wrap{}
+	for _, index := range s.indexes {
+		index.keys = btree.New(s.degree)
+	}
+	if s.deadlines != nil {
+		s.deadlines.clear()
+	}
+	s.checkSize()
+
+	return err
+}
+
 // PutAll places multiple items into the store on a single lock
+// Nil items (including typed nil pointers) are skipped with a logged warning. If any items fail, the returned error is
+// a *PutAllError identifying them by position. As for Put, items which could not be persisted are still stored and
+// their events emitted, and their Change in the batch passed to OnBatch handlers carries the error.
 func (s *Store) PutAll(items []interface{}) error {
 	s.Lock()
 	defer s.Unlock()
 
-	errs := 0
-	for _, item := range items {
+	if s.closed {
+		return ErrClosed
+	}
+
+	var (
+		failed  []PutFailure
+		changes []Change
+	)
+	for i, item := range items {
+		if isNil(item) {
+			s.log("warn", "skipped nil item", "index", i)
+			continue
+		}
+		if err := s.checkItem(item); err != nil {
+			failed = append(failed, PutFailure{Index: i, Err: err})
+			continue
+		}
+		if err := s.checkConflicts(item); err != nil {
+			failed = append(failed, PutFailure{Index: i, Err: err})
+			continue
+		}
+
 		newWrap, oldWrap, err := s.add(item)
 
 		if oldWrap == nil {
-			s.happens <- &happening{
-				event: Insert,
-				new:   item,
-				stats: newWrap.stats,
-			}
+			s.notify(Insert, nil, item, newWrap.stats.copy())
+			changes = append(changes, Change{Event: Insert, New: item, Stats: newWrap.stats.copy(), Err: err})
 		} else if oldWrap != none {
-			s.happens <- &happening{
-				event: Update,
-				old:   oldWrap.item,
-				new:   item,
-				stats: newWrap.stats,
-			}
+			s.notify(Update, oldWrap.item, item, newWrap.stats.copy())
+			changes = append(changes, Change{Event: Update, Old: oldWrap.item, New: item, Stats: newWrap.stats.copy(), Err: err})
+		}
+
+		if err != nil {
+			failed = append(failed, PutFailure{Index: i, Err: err, Stored: true})
 		}
+	}
+
+	if len(changes) > 0 && len(s.batchNotifiers) > 0 {
+		s.happens <- &happening{changes: changes}
+	}
+	s.checkSize()
+
+	if len(failed) > 0 {
+		return &PutAllError{Failures: failed}
+	}
+	return nil
+}
+
+// PutFailure identifies an item which PutAll or Merge failed to put or persist
+type PutFailure struct {
+	// Index is the position of the item in the items passed to PutAll, or in the other store for Merge
+	Index int
+
+	// Err is the reason the item failed
+	Err error
+
+	// Stored is set for items which were stored, and had their events emitted, but could not be persisted
+	Stored bool
+}
+
+// PutAllError is returned by PutAll or Merge when any of the items failed, listing each failed item in order
+type PutAllError struct {
+	Failures []PutFailure
+}
+
+func (e *PutAllError) Error() string {
+	return fmt.Sprintf("%d errors occurred during operation", len(e.Failures))
+}
+
+// Merge places all items from the other store into this store, calling resolve to pick a winner when an equal item
+// already exists in this store. When the winner is the existing item, no change is made, otherwise the winner is
+// stored as if it were Put, keeping the existing item's Stats (as for any update) and being assigned a new UID.
+// Items being inserted receive fresh Stats and UIDs in this store. Items are checked as for Put, and if any fail the
+// returned error is a *PutAllError identifying them by their position in the other store's ascending order.
+func (s *Store) Merge(other *Store, resolve func(existing, incoming interface{}) interface{}) error {
+	if other == s {
+		return fmt.Errorf("Cannot merge a store into itself")
+	}
+
+	var incoming []interface{}
+	other.RLock()
+	other.backing.Ascend(func(item btree.Item) bool {
+		if w, ok := item.(*wrap); ok {
+			incoming = append(incoming, w.item)
+		}
+		return true
+	})
+	other.RUnlock()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	var failed []PutFailure
+	for i, item := range incoming {
+		if found := s.backing.Get(&wrap{storer: s, item: item}); found != nil {
+			existing := found.(*wrap).item
+			item = resolve(existing, item)
+			if sameItem(item, existing) {
+				continue
+			}
+		}
+
+		if result, err := s.putResult(item); err != nil {
+			failed = append(failed, PutFailure{Index: i, Err: err, Stored: result != nil})
+		}
+	}
+
+	if len(failed) > 0 {
+		return &PutAllError{Failures: failed}
+	}
+	return nil
+}
+
+// sameItem returns whether a and b are the same item, comparing items of types that cannot be compared with == by
+// their contents rather than panicking
+func sameItem(a, b interface{}) bool {
+	if placeable(a) && placeable(b) {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// UpdateIf calls mutate on each item for which pred returns true, then re-indexes, persists and emits an Update event
+// for each mutated item, all under a single lock. Returns the number of items updated.
+// The mutate function MUST NOT change the primary key of the items (see Store), as items are updated in place. Each
+// mutated item is put as for Put, keeping its UID. As a mutation cannot be undone, an item which then fails the checks
+// made by Put is left held under its previous index keys, and counted as an error rather than updated.
+func (s *Store) UpdateIf(pred func(item interface{}) bool, mutate func(item interface{})) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	var matched []*wrap
+	s.backing.Ascend(func(item btree.Item) bool {
+		if w, ok := item.(*wrap); ok && pred(w.item) {
+			matched = append(matched, w)
+		}
+		return true
+	})
+
+	errs := 0
+	updated := 0
+	for _, w := range matched {
+		if s.backing.Get(w) != w {
+			// Replaced via a unique index by an earlier update
+			continue
+		}
+
+		mutate(w.item)
+		result, err := s.putItem(w.item, w.uid)
+		if result != nil {
+			updated++
+		}
+		if err != nil {
+			errs++
+		}
+	}
+
+	if errs > 0 {
+		return updated, fmt.Errorf("%d errors occurred during operation", errs)
+	}
+	return updated, nil
+}
+
+// Put places an item into the store, returns the old replaced item (if any)
+// No old item is returned when the only items replaced were held under the same key in a unique index, use
+// PutWithResult to distinguish this from an insert. Putting a nil item (including a typed nil pointer) returns ErrNil.
+func (s *Store) Put(item interface{}) (old interface{}, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.put(item)
+}
+
+func (s *Store) put(item interface{}) (old interface{}, err error) {
+	var result *PutResult
+	result, err = s.putResult(item)
+	if result != nil {
+		old = result.Old
+	}
+	return
+}
+
+// PutAction describes what a put did, see PutWithResult
+type PutAction int
+
+const (
+	// Inserted items did not replace any items in the store
+	Inserted PutAction = iota
+
+	// Updated items replaced an equal item in the store (and may also have replaced others in unique indexes)
+	Updated
+
+	// ReplacedByUnique items replaced only items which were not equal, but held the same key in a unique index
+	ReplacedByUnique
+)
+
+// PutResult describes the outcome of PutWithResult
+type PutResult struct {
+	Action PutAction
+
+	// Old is the equal item which was replaced, if the Action is Updated
+	Old interface{}
+
+	// Replaced are the items which were removed for holding the same key in a unique index as the put item
+	Replaced []interface{}
+}
+
+// PutWithResult places an item into the store as for Put, returning a PutResult describing whether it was inserted or
+// replaced existing items
+// Unlike Put, which returns no old item when the only items replaced were those held under the same key in a unique
+// index, the result distinguishes this from an insert and lists the items replaced.
+func (s *Store) PutWithResult(item interface{}) (*PutResult, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.putResult(item)
+}
+
+func (s *Store) putResult(item interface{}) (*PutResult, error) {
+	return s.putItem(item, "")
+}
+
+// putItem checks, stores, persists and emits the events for an item as for Put, keeping uid as its UID if given (and
+// the store has no UID func)
+func (s *Store) putItem(item interface{}, uid UID) (*PutResult, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if err := s.checkItem(item); err != nil {
+		return nil, err
+	}
+	if err := s.checkConflicts(item); err != nil {
+		return nil, err
+	}
+
+	w := s.wrapIt(item)
+	if uid != "" && s.uidFunc == nil {
+		w.uid = uid
+	}
+	ow, replaced := s.insertWrap(w)
+	err := s.save(w)
+
+	result := &PutResult{}
+	for _, r := range replaced {
+		result.Replaced = append(result.Replaced, r.item)
+	}
+
+	switch {
+	case ow != nil:
+		result.Action = Updated
+		result.Old = ow.item
+		s.notify(Update, ow.item, item, w.stats.copy())
+	case len(replaced) > 0:
+		result.Action = ReplacedByUnique
+	default:
+		s.notify(Insert, nil, item, w.stats.copy())
+	}
+	s.checkSize()
+	return result, err
+}
+
+// GetOrPut returns the item equal to the passed item if one exists, with loaded set to true, otherwise it inserts and
+// returns the item from calling create (or item itself if create is nil), with loaded set to false
+// The check and insert are performed under a single lock, so only one caller will ever create a missing item. The
+// created item should be equal to item, create must not call back into the store.
+func (s *Store) GetOrPut(item interface{}, create func() interface{}) (value interface{}, loaded bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil, false, ErrClosed
+	}
+
+	if found := s.get(item); found != nil {
+		return found, true, nil
+	}
+
+	value = item
+	if create != nil {
+		value = create()
+	}
+	_, err = s.put(value)
+	return value, false, err
+}
+
+// Replace swaps the stored item equal to old for new, keeping the old item's UID and stats (including its created time)
+// and reindexing it, as an Update
+// Keeping the UID means a persister overwrites the old item's record rather than creating a new one. The new item may
+// have a different primary key to old, if it is equal to another stored item, that item is removed.
+func (s *Store) Replace(old, new interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.checkItem(new); err != nil {
+		return err
+	}
+
+	search := &wrap{storer: s, item: old}
+	found := s.backing.Get(search)
+	if found == nil {
+		return fmt.Errorf("Item to replace was not found in the store")
+	}
+	if err := s.conflicts(new, found.(*wrap)); err != nil {
+		return err
+	}
+
+	ow := s.detach(search)
+	saved := ow.stats.copy()
+
+	w := s.wrapIt(new)
+	w.uid = ow.uid
+	displaced := s.addWrap(w)
+	if displaced != nil && displaced != none {
+		if s.persister != nil {
+			if err := s.persister.Remove(string(displaced.uid)); err != nil {
+				s.log("warn", "unable to remove displaced item", "item", displaced.item, "error", err)
+			}
+		}
+		s.notify(Remove, displaced.item, nil, displaced.stats.copy())
+	}
+
+	w.stats.set(saved)
+	w.stats.pin(saved.Pinned)
+	w.stats.written(time.Now())
+	if s.deadlines != nil {
+		// Recorded by addWrap before the kept stats were restored, which may bring the deadline forward
+		s.deadlines.push(w)
+	}
+
+	err := s.save(w)
+	s.notify(Update, ow.item, new, w.stats.copy())
+	return err
+}
+
+// Delete removes an item equal to the search item, returns the deleted item (if any)
+// Deleting a nil item (including a typed nil pointer) returns ErrNil.
+func (s *Store) Delete(search interface{}) (old interface{}, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.delete(search)
+}
+
+func (s *Store) delete(search interface{}) (old interface{}, err error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if isNil(search) {
+		return nil, ErrNil
+	}
+	var oldWrap *wrap
+	oldWrap, err = s.rm(search)
+	if oldWrap != nil {
+		old = oldWrap.item
+		s.notify(Remove, old, nil, oldWrap.stats.copy())
+		s.checkSize()
+	}
+	return
+}
+
+// GetAndDelete atomically fetches and removes an item equal to the search item, returns the removed item and whether
+// it existed
+// Only one of several concurrent callers for the same item will receive it, making it suitable for claiming work.
+// A failure to remove the item from the persister is logged, the item is removed from the store regardless.
+func (s *Store) GetAndDelete(search interface{}) (interface{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil, false
+	}
+
+	old, err := s.delete(search)
+	if err != nil {
+		s.log("warn", "unable to delete item", "item", search, "error", err)
+	}
+	return old, old != nil
+}
+
+// DeleteIf removes an item equal to the search item only if cond returns true when called with the currently stored
+// item, returns the deleted item (if any) and whether it was deleted
+// The check and removal are performed under a single lock, so the item cannot change in between.
+func (s *Store) DeleteIf(search interface{}, cond func(current interface{}) bool) (old interface{}, deleted bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil, false, ErrClosed
+	}
+
+	found := s.backing.Get(&wrap{
+		storer: s,
+		item:   search,
+	})
+	if found == nil {
+		return
+	}
+
+	w := found.(*wrap)
+	if !cond(w.item) {
+		return
+	}
+
+	var oldWrap *wrap
+	oldWrap, err = s.rm(w)
+	if oldWrap != nil {
+		old = oldWrap.item
+		deleted = true
+		s.notify(Remove, old, nil, oldWrap.stats.copy())
+		s.checkSize()
+	}
+	return
+}
+
+// Len returns the number of items in the database
+func (s *Store) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.backing.Len()
+}
+
+// IsEmpty returns whether there are no items in the database
+func (s *Store) IsEmpty() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.backing.Len() == 0
+}
+
+// Indexes returns the list of indexed indexes
+func (s *Store) Indexes() [][]string {
+	s.RLock()
+	defer s.RUnlock()
+
+	c := make([][]string, len(s.indexes))
+	for _, f := range s.indexes {
+		fc := make([]string, len(f.fields))
+		copy(fc, f.fields)
+		c[f.n] = fc
+	}
+	return c
+}
+
+// IndexInfo describes the definition of one of the store's indexes, or its primary key
+type IndexInfo struct {
+	// Name is the index's id (its fields joined by "\000"), as accepted by IndexByID and OnConflict
+	Name   string
+	Fields []string
+
+	Unique   bool
+	Primary  bool
+	Computed bool
+	Partial  bool
+	Numeric  bool
+	Ordered  bool
+}
+
+// IndexInfo returns the definitions of the store's indexes in the order they were created
+// The unique index created by PrimaryKey is reported as Primary.
+func (s *Store) IndexInfo() []*IndexInfo {
+	s.RLock()
+	defer s.RUnlock()
+
+	primary := ""
+	if len(s.primaryKey) > 0 {
+		primary = strings.Join(s.primaryKey, "\000")
+	}
+
+	c := make([]*IndexInfo, 0, len(s.indexes))
+	for _, index := range s.sortedIndexes() {
+		c = append(c, &IndexInfo{
+			Name:     index.id,
+			Fields:   append([]string{}, index.fields...),
+			Unique:   index.unique,
+			Primary:  index.id == primary,
+			Computed: index.compute != nil,
+			Partial:  index.where != nil,
+			Numeric:  index.numeric,
+			Ordered:  index.ordered,
+		})
+	}
+	return c
+}
+
+// Keys returns the list of distinct keys for an index
+func (s *Store) Keys(fields ...string) []string {
+	f := s.In(fields...)
+	if f == nil {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	index, ok := s.index[f._id()]
+	if !ok {
+		return nil
+	}
+
+	keys := make([]string, len(index))
+	i := 0
+	for key := range index {
+		keys[i] = key
+		i++
+	}
+	return keys
+}
+
+// KeysSorted returns the list of distinct keys for an index in ascending string order (or descending if the store is
+// reversed)
+func (s *Store) KeysSorted(fields ...string) []string {
+	keys := s.Keys(fields...)
+	s.sortKeys(keys)
+	return keys
+}
+
+// EachKey calls provided callback function with each distinct key for an index and the number of items it holds, in
+// ascending string order (or descending if the store is reversed), until end or callback returns false
+func (s *Store) EachKey(cb func(key string, count int) bool, fields ...string) {
+	f := s.In(fields...)
+	if f == nil {
+		return
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	index, ok := s.index[f._id()]
+	if !ok {
+		return
+	}
+
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	s.sortKeys(keys)
+
+	for _, key := range keys {
+		if !cb(key, len(index[key])) {
+			return
+		}
+	}
+}
+
+// IndexCardinality returns the number of distinct keys held in an index
+func (s *Store) IndexCardinality(fields ...string) int {
+	f := s.In(fields...)
+	if f == nil {
+		return 0
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.index[f._id()])
+}
+
+// LenIn returns the number of items held in an index, or 0 if there is no such index
+// It can be less than Len for partial indexes created with Where. It is the sum of the index's
+// bucket sizes, so items held under several keys of the index are counted once for each key.
+func (s *Store) LenIn(fields ...string) int {
+	f := s.In(fields...)
+	if f == nil {
+		return 0
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	n := 0
+	for _, wraps := range s.index[f._id()] {
+		n += len(wraps)
+	}
+	return n
+}
+
+// BucketSizes returns the number of items held under each distinct key of an index
+func (s *Store) BucketSizes(fields ...string) map[string]int {
+	f := s.In(fields...)
+	if f == nil {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	index, ok := s.index[f._id()]
+	if !ok {
+		return nil
+	}
+
+	sizes := make(map[string]int, len(index))
+	for key, wraps := range index {
+		sizes[key] = len(wraps)
+	}
+	return sizes
+}
+
+// pointerSize is the size in bytes of a pointer, as held in the index buckets
+const pointerSize = strconv.IntSize / 8
+
+// IndexMemoryEstimate returns an estimate of the bytes held by each index, keyed by index id (the index's fields joined
+// by "\000")
+// The estimate is the total length of the index's keys plus the size of the item pointers in each key's bucket. It is
+// an approximation which does not include the overhead of the maps, slice headers and the items themselves.
+func (s *Store) IndexMemoryEstimate() map[string]uint64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	estimates := make(map[string]uint64, len(s.indexes))
+	for id := range s.indexes {
+		var size uint64
+		for key, wraps := range s.index[id] {
+			size += uint64(len(key) + len(wraps)*pointerSize)
+		}
+		estimates[id] = size
+	}
+	return estimates
+}
+
+// IndexRange calls provided callback function for each item whose key in the index is between from and to
+// (inclusive), in ascending key order, until end or iterator function returns false
+// Items sharing the same key are not guaranteed to be in any particular order.
+func (s *Store) IndexRange(fields []string, from, to []string, cb Iterator) {
+	s.rlockOpen()
+	defer s.RUnlock()
+
+	index, ok := s.indexes[strings.Join(fields, "\000")]
+	if !ok {
+		return
+	}
+
+	indexWraps := s.index[index.id]
+	last := indexKey(index.key(to))
+	seen := map[*wrap]bool{}
+	now := time.Now()
+	index.keys.AscendGreaterOrEqual(indexKey(index.key(from)), func(item btree.Item) bool {
+		key := item.(indexKey)
+		if last.Less(key) {
+			return false
+		}
+
+		for _, wrapped := range indexWraps[string(key)] {
+			if seen[wrapped] {
+				continue
+			}
+			seen[wrapped] = true
+
+			s.access(wrapped, now)
+			if !cb(wrapped.item) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+type IndexStats struct {
+	Key   []string
+	Count uint64
+	Size  uint64
+}
+
+// IndexStats returns the list of distinct keys for an index along with stats of the items held.
+// The Size field represents stored (on disk) size of items, if using a persister, and will be 0 otherwise.
+func (s *Store) IndexStats(fields ...string) []*IndexStats {
+	f := s.In(fields...)
+	if f == nil {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.indexStats(f._id())
+}
+
+// AllIndexStats returns the IndexStats for every index in the store, keyed by index id (the index's fields joined by
+// "\000"), gathered under a single lock.
+func (s *Store) AllIndexStats() map[string][]*IndexStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	all := make(map[string][]*IndexStats, len(s.indexes))
+	for id := range s.indexes {
+		all[id] = s.indexStats(id)
+	}
+	return all
+}
+
+func (s *Store) indexStats(id string) []*IndexStats {
+	index, ok := s.index[id]
+	if !ok {
+		return nil
+	}
+
+	keys := make([]*IndexStats, len(index))
+	i := 0
+	for key, wraps := range index {
+		var size uint64
+		if _, ok := s.persister.(persist.MetaPersister); ok {
+			for _, wrap := range wraps {
+				size += wrap.stats.Size
+			}
+		}
+		keys[i] = &IndexStats{
+			Key:   s.splitKey(key),
+			Count: uint64(len(wraps)),
+			Size:  size,
+		}
+		i++
+	}
+	return keys
+}
+
+// StoreStats contains aggregated statistics for all items in a store
+type StoreStats struct {
+	Items          int
+	Indexes        int
+	TotalReads     uint64
+	TotalWrites    uint64
+	TotalSize      uint64
+	OldestCreated  time.Time
+	NewestModified time.Time
+}
+
+// StoreStats returns aggregated statistics for all of the items in the store, this is O(n) over the items
+// The TotalSize field represents stored (on disk) size of items, if using a persister, and will be 0 otherwise.
+func (s *Store) StoreStats() *StoreStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	ss := &StoreStats{
+		Items:   s.backing.Len(),
+		Indexes: len(s.indexes),
+	}
+
+	s.backing.Ascend(func(item btree.Item) bool {
+		if w, ok := item.(*wrap); ok {
+			stats := w.stats.copy()
+			ss.TotalReads += stats.Reads
+			ss.TotalWrites += stats.Writes
+			ss.TotalSize += stats.Size
+			if ss.OldestCreated.IsZero() || stats.Created.Before(ss.OldestCreated) {
+				ss.OldestCreated = stats.Created
+			}
+			if stats.Modified.After(ss.NewestModified) {
+				ss.NewestModified = stats.Modified
+			}
+		}
+		return true
+	})
+
+	return ss
+}
+
+// On registers an event handler for an event type
+// Handlers are called on the store's event goroutine without the store's lock held, so may call the store's methods,
+// including writing to it. Events caused by a handler are queued behind those already waiting, and their handlers are
+// called after the current handler returns, never recursively. A handler whose writes cause its own event type again
+// (or which reads items from an Access handler) must stop the chain itself. The event buffer is drained by the handler's
+// own goroutine, so a handler that writes must not do so while the buffer is full.
+func (s *Store) On(event Event, notify NotifyFunc) {
+	s.Lock()
+	defer s.Unlock()
+	s.notifiers.Lock()
+	defer s.notifiers.Unlock()
+
+	switch event {
+	case Insert:
+		s.insertNotifiers = append(s.insertNotifiers, notify)
+	case Update:
+		s.updateNotifiers = append(s.updateNotifiers, notify)
+	case Remove:
+		s.removeNotifiers = append(s.removeNotifiers, notify)
+	case Expiry:
+		s.expiryNotifiers = append(s.expiryNotifiers, notify)
+	case Access:
+		s.accessNotifiers = append(s.accessNotifiers, notify)
+	default:
+		return
+	}
+}
+
+// SetTrackAccess sets whether reads are counted in the Reads and Accessed stats of items, and emit Access events
+// Tracking is on by default. Turning it off saves the cost of recording every read and of queueing an Access event for
+// each item read, for read heavy stores which do not need them. Writes are tracked either way, and the SetOnAccess hook
+// is still called.
+func (s *Store) SetTrackAccess(track bool) {
+	var noAccess int32
+	if !track {
+		noAccess = 1
+	}
+	atomic.StoreInt32(&s.noAccess, noAccess)
+}
+
+// SetOnAccess sets a hook which is called synchronously with each item returned by Get, or an index's One or Lookup
+// The hook is called after the store's lock has been released, so may safely call back into the store (e.g. to
+// prefetch related items). It is not called for items visited by bulk iteration.
+func (s *Store) SetOnAccess(hook func(item interface{})) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.onAccess = hook
+}
+
+// ExpiredChan returns a channel which receives each item as it is expired, alongside any Expiry event handlers
+// Every call returns the same channel, which is closed by Close once all pending events have been emitted. Items are
+// delivered by the store's event goroutine, so once the channel's buffer is full, all of the store's events wait for
+// items to be read from it.
+func (s *Store) ExpiredChan() <-chan interface{} {
+	s.Lock()
+	defer s.Unlock()
+
+	s.mustBeOpen()
+	if s.expired == nil {
+		expired := make(chan interface{}, expiredBuffer)
+		s.expired = expired
+		s.notifiers.Lock()
+		defer s.notifiers.Unlock()
+		s.expiryNotifiers = append(s.expiryNotifiers, func(event Event, old, new interface{}, stats Stats) {
+			expired <- old
+		})
+	}
+	return s.expired
+}
+
+// OnBatch registers a handler to receive all of the changes made by a PutAll in a single call
+// Handlers registered via On will still receive the individual events.
+func (s *Store) OnBatch(notify BatchNotifyFunc) {
+	s.Lock()
+	defer s.Unlock()
+	s.notifiers.Lock()
+	defer s.notifiers.Unlock()
+
+	s.batchNotifiers = append(s.batchNotifiers, notify)
+}
+
+// SetParallelNotify sets whether handlers for each event type are called on their own goroutine
+// By default all events are emitted in order on a single goroutine, so a slow handler delays the events of every other
+// type. With parallel notification, events of the same type (and batches, and size crossings) are still emitted in the
+// order they happened, but events of different types are no longer ordered relative to each other, e.g. a Remove
+// handler may be called before the Insert handler for the same item. Must be called before the store is used.
+func (s *Store) SetParallelNotify(parallel bool) *Store {
+	if s.used {
+		panic("Cannot change parallel notify on in-use store")
+	}
+	if parallel == (s.lanes != nil) {
+		return s
+	}
+
+	if !parallel {
+		for _, lane := range s.lanes {
+			close(lane)
+		}
+		s.laneWait.Wait()
+		s.lanes = nil
+		return s
+	}
+
+	s.lanes = make([]chan *happening, happeningLanes)
+	for i := range s.lanes {
+		lane := make(chan *happening, cap(s.happens))
+		s.lanes[i] = lane
+		s.laneWait.Add(1)
+		go func() {
+			defer s.laneWait.Done()
+			for h := range lane {
+				s.deliver(h)
+			}
+		}()
+	}
+	return s
+}
+
+// NotifyBacklog returns the number of events which have been queued but not yet emitted to their handlers
+// Writers block once the event buffer fills, so a growing backlog indicates handlers that are not keeping up. With
+// parallel notification this includes events waiting for each event type's goroutine.
+func (s *Store) NotifyBacklog() int {
+	n := len(s.happens)
+	for _, lane := range s.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// OnConflict sets a handler for a unique index, which is called when a put item holds the same key in the index as an
+// existing item (other than an equal item it would update)
+// Returning true allows the existing item to be replaced, as happens without a handler, while returning false rejects
+// the put with ErrConflict, leaving the existing item in place. The index is given by its id (the index's fields joined
+// by "\000"). The handler is called with the store's lock held, so MUST NOT call the store's methods.
+func (s *Store) OnConflict(index string, handler ConflictFunc) {
+	s.Lock()
+	defer s.Unlock()
+
+	idx, ok := s.indexes[index]
+	if !ok || !idx.unique {
+		panic(fmt.Sprintf("Cannot set conflict handler on %q, it is not a unique index", index))
+	}
+	idx.onConflict = handler
+}
+
+// checkConflicts returns ErrConflict if the item holds the same key as an existing item in a unique index, and the
+// index's conflict handler rejects replacing the existing item
+func (s *Store) checkConflicts(item interface{}) error {
+	return s.conflicts(item, nil)
+}
+
+// conflicts is checkConflicts, ignoring the replacing wrap which the item is about to take the place of
+func (s *Store) conflicts(item interface{}, replacing *wrap) error {
+	for _, index := range s.sortedIndexes() {
+		if index.onConflict == nil || (index.where != nil && !index.where(item)) {
+			continue
+		}
+
+		for _, key := range s.indexKeys(item, index) {
+			for _, existing := range s.index[index.id][key] {
+				if existing == replacing {
+					continue
+				}
+				if !s.Less(existing.item, item) && !s.Less(item, existing.item) {
+					continue
+				}
+				if !index.onConflict(existing.item, item) {
+					return ErrConflict
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sizeWatch is a pair of watermarks registered by OnSize, above is whether the high watermark was last crossed
+type sizeWatch struct {
+	high   int
+	low    int
+	notify SizeFunc
+	above  bool
+}
+
+// OnSize registers a handler which is called when the number of items in the store rises above high, and again when
+// it then falls below low
+// The gap between high and low prevents the handler being called repeatedly as the count fluctuates around a single
+// watermark. The count is checked after each Put, Delete and Expire (and their bulk equivalents), and the handler is
+// called asynchronously, in order with events.
+func (s *Store) OnSize(high, low int, notify SizeFunc) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sizeWatches = append(s.sizeWatches, &sizeWatch{
+		high:   high,
+		low:    low,
+		notify: notify,
+	})
+}
+
+// checkSize calls the OnSize handlers for any watermarks the store's count has crossed, must be called with the
+// store's lock held
+func (s *Store) checkSize() {
+	if len(s.sizeWatches) == 0 {
+		return
+	}
+
+	count := s.backing.Len()
+	for _, watch := range s.sizeWatches {
+		switch {
+		case !watch.above && count > watch.high:
+			watch.above = true
+		case watch.above && count < watch.low:
+			watch.above = false
+		default:
+			continue
+		}
+
+		s.happens <- &happening{crossing: &crossing{
+			notify: watch.notify,
+			count:  count,
+			rising: watch.above,
+		}}
+	}
+}
+
+// OnExpiring registers a hook that is called for each item Expire is about to remove, before it is removed
+// Returning false keeps the item and refreshes its modified time, and the item is not considered for expiry again until
+// an expire interval (see ExpireInterval) has passed, whichever expirer is in use. Unlike the Expiry event, which is
+// sent after removal, the hook is called synchronously from within Expire.
+func (s *Store) OnExpiring(hook ExpiringFunc) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expiringHooks = append(s.expiringHooks, hook)
+}
+
+// vetoExpiring filters out any expiring wraps which an OnExpiring hook has chosen to keep, returning those still to be
+// expired and those kept
+// It is called without the store's lock held, so the kept wraps must be requeued once the lock is taken again.
+func (s *Store) vetoExpiring(rm []*wrap) ([]*wrap, []*wrap) {
+	s.RLock()
+	hooks := s.expiringHooks
+	s.RUnlock()
+
+	if len(hooks) == 0 {
+		return rm, nil
+	}
+
+	now := time.Now()
+	backoff := time.Duration(atomic.LoadInt64(&s.tickerDelay))
+	keep := rm[:0]
+	var vetoed []*wrap
+	for _, w := range rm {
+		stats := w.stats.copy()
+		expire := true
+		for _, hook := range hooks {
+			if !hook(w.item, stats) {
+				expire = false
+				break
+			}
+		}
+
+		if expire {
+			keep = append(keep, w)
+		} else {
+			w.stats.refresh(now)
+			w.Lock()
+			w.held = now.Add(backoff)
+			w.Unlock()
+			vetoed = append(vetoed, w)
+		}
+	}
+	return keep, vetoed
+}
+
+// stillStored returns the wraps which are still stored, must be called with the store's lock held
+func (s *Store) stillStored(ws []*wrap) []*wrap {
+	var stored []*wrap
+	for _, w := range ws {
+		if s.backing.Get(w) == w {
+			stored = append(stored, w)
+		}
+	}
+	return stored
+}
+
+// findExpired returns the wraps which are due to expire, stopping once limit have been found (if limit is non-zero)
+// Must be called with the store's lock held.
+func (s *Store) findExpired(now time.Time, limit int) []*wrap {
+	if s.deadlines != nil {
+		return s.findDue(now, limit)
+	}
+
+	var rm []*wrap
+	s.backing.Ascend(func(item btree.Item) bool {
+		if w, ok := item.(*wrap); ok {
+			w.RLock()
+			if w.expirable(now) && s.IsExpired(w.item, now, w.stats) {
+				rm = append(rm, w)
+			}
+			w.RUnlock()
+		}
+		return limit == 0 || len(rm) < limit
+	})
+
+	return rm
+}
+
+// findDue returns the wraps which are due to expire using the tracked deadlines, stopping once limit have been found
+// (if limit is non-zero)
+func (s *Store) findDue(now time.Time, limit int) []*wrap {
+	var rm, keep []*wrap
+	for limit == 0 || len(rm) < limit {
+		want := 0
+		if limit > 0 {
+			want = limit - len(rm)
+		}
+
+		due := s.deadlines.due(now, want)
+		if len(due) == 0 {
+			break
+		}
+
+		for _, w := range due {
+			if found := s.backing.Get(w); found != btree.Item(w) {
+				// Replaced or removed since the deadline was recorded
+				continue
+			}
+
+			w.RLock()
+			if w.expirable(now) && s.IsExpired(w.item, now, w.stats) {
+				rm = append(rm, w)
+			} else {
+				keep = append(keep, w)
+			}
+			w.RUnlock()
+		}
+	}
+
+	s.requeue(keep)
+	return rm
+}
+
+// notify queues an event for emission, assigning it the next sequence number for the store
+func (s *Store) notify(event Event, old, new interface{}, stats Stats) {
+	stats.Seq = atomic.AddUint64(&s.sequence, 1)
+	if len(s.happens) == cap(s.happens) {
+		s.log("warn", "event buffer full: blocking until events are emitted", "event", event)
+	}
+	s.happens <- &happening{
+		event: event,
+		old:   old,
+		new:   new,
+		stats: stats,
+	}
+}
+
+// checkItem returns an error if the item is nil or fails the store's strict key, strict field or UID checks
+func (s *Store) checkItem(item interface{}) error {
+	if isNil(item) {
+		return ErrNil
+	}
+	if err := s.checkPlacement(item); err != nil {
+		return err
+	}
+	if err := s.checkUID(item); err != nil {
+		return err
+	}
+	return s.checkFields(item)
+}
 
-		if err != nil {
-			errs++
-		}
+// checkUID returns an error if the store has a UID func and it gives an empty UID for the item, or the UID of a
+// different item in the store
+func (s *Store) checkUID(item interface{}) error {
+	if s.uidFunc == nil {
+		return nil
 	}
 
-	if errs > 0 {
-		return fmt.Errorf("%d errors occurred during operation", errs)
+	uid := s.uidFunc(item)
+	if uid == "" {
+		return fmt.Errorf("UID func returned an empty UID for item of type %T", item)
+	}
+
+	w, ok := s.uids[uid]
+	if ok && (s.Less(w.item, item) || s.Less(item, w.item)) {
+		return fmt.Errorf("UID %s is already used by a different item", uid)
 	}
 	return nil
 }
 
-// Put places an item into the store, returns the old replaced item (if any)
-func (s *Store) Put(item interface{}) (old interface{}, err error) {
-	s.Lock()
-	defer s.Unlock()
-
-	var newWrap, oldWrap *wrap
-	newWrap, oldWrap, err = s.add(item)
+// checkFields returns an error naming the first indexed field which resolves empty for the item, if strict fields are
+// enabled
+func (s *Store) checkFields(item interface{}) error {
+	if !s.fields || s.fielder != nil {
+		return nil
+	}
+	if _, ok := item.(Fielder); ok {
+		return nil
+	}
 
-	if oldWrap == nil {
-		s.happens <- &happening{
-			event: Insert,
-			new:   item,
-			stats: newWrap.stats,
+	for _, index := range s.sortedIndexes() {
+		if index.compute != nil || (index.where != nil && !index.where(item)) {
+			continue
 		}
-	} else if oldWrap != none {
-		old = oldWrap.item
-		s.happens <- &happening{
-			event: Update,
-			old:   old,
-			new:   item,
-			stats: newWrap.stats,
+		for _, field := range index.fields {
+			if s.GetField(item, field) == "" {
+				return fmt.Errorf("Indexed field %q did not resolve for item of type %T", field, item)
+			}
 		}
 	}
-	return
+	return nil
 }
 
-// Delete removes an item equal to the search item, returns the deleted item (if any)
-func (s *Store) Delete(search interface{}) (old interface{}, err error) {
-	s.Lock()
-	defer s.Unlock()
-
-	var oldWrap *wrap
-	oldWrap, err = s.rm(search)
-	if oldWrap != nil {
-		old = oldWrap.item
-		s.happens <- &happening{
-			event: Remove,
-			old:   old,
-			stats: oldWrap.stats,
-		}
+// sortedIndexes returns the store's indexes in the order they were created
+func (s *Store) sortedIndexes() []*Index {
+	indexes := make([]*Index, len(s.indexes))
+	for _, index := range s.indexes {
+		indexes[index.n] = index
 	}
-	return
+	return indexes
 }
 
-// Len returns the number of items in the database
-func (s *Store) Len() int {
-	s.RLock()
-	defer s.RUnlock()
-
-	return s.backing.Len()
+// mustBeOpen panics if the store has been closed, must be called with the store's lock held
+func (s *Store) mustBeOpen() {
+	if s.closed {
+		panic("memdb: use of closed store")
+	}
 }
 
-// Indexes returns the list of indexed indexes
-func (s *Store) Indexes() [][]string {
+// rlockOpen takes the store's read lock, for use at the start of reads which release it themselves, panicking (without
+// the lock held) if the store has been closed
+func (s *Store) rlockOpen() {
 	s.RLock()
-	defer s.RUnlock()
-
-	c := make([][]string, len(s.indexes))
-	for _, f := range s.indexes {
-		fc := make([]string, len(f.fields))
-		copy(fc, f.fields)
-		c[f.n] = fc
+	if s.closed {
+		s.RUnlock()
+		panic("memdb: use of closed store")
 	}
-	return c
 }
 
-// Keys returns the list of distinct keys for an index
-func (s *Store) Keys(fields ...string) []string {
-	f := s.In(fields...)
-	if f == nil {
+// checkPlacement returns an error if strict keys are enabled and the item has been moved since it was stored
+func (s *Store) checkPlacement(item interface{}) error {
+	if !s.strict || !placeable(item) {
 		return nil
 	}
 
-	s.RLock()
-	defer s.RUnlock()
-
-	index, ok := s.index[f._id()]
+	w, ok := s.placed[item]
 	if !ok {
 		return nil
 	}
 
-	keys := make([]string, len(index))
-	i := 0
-	for key := range index {
-		keys[i] = key
-		i++
+	if found := s.backing.Get(w); found != w {
+		return fmt.Errorf("Primary key of stored item (uid %s) has changed, delete the item before changing its key", w.uid)
 	}
-	return keys
+	return nil
 }
 
-type IndexStats struct {
-	Key   []string
-	Count uint64
-	Size  uint64
+// place records the wrap as the stored location of its item for checkPlacement
+func (s *Store) place(w *wrap) {
+	if s.strict && placeable(w.item) {
+		s.placed[w.item] = w
+	}
 }
 
-// IndexStats returns the list of distinct keys for an index along with stats of the items held.
-// The Size field represents stored (on disk) size of items, if using a persister, and will be 0 otherwise.
-func (s *Store) IndexStats(fields ...string) []*IndexStats {
-	f := s.In(fields...)
-	if f == nil {
-		return nil
+// unplace removes the wrap as the stored location of its item
+func (s *Store) unplace(w *wrap) {
+	if s.strict && placeable(w.item) && s.placed[w.item] == w {
+		delete(s.placed, w.item)
 	}
+}
 
-	s.RLock()
-	defer s.RUnlock()
-
-	index, ok := s.index[f._id()]
-	if !ok {
-		return nil
+// isNil returns whether the item is nil, or a nil pointer, map, slice, etc. held in a non-nil interface
+func isNil(item interface{}) bool {
+	if item == nil {
+		return true
 	}
 
-	keys := make([]*IndexStats, len(index))
-	i := 0
-	for key, wraps := range index {
-		var size uint64
-		if _, ok := s.persister.(persist.MetaPersister); ok {
-			for _, wrap := range wraps {
-				size += wrap.stats.Size
-			}
-		}
-		keys[i] = &IndexStats{
-			Key:   strings.Split(key, "\000"),
-			Count: uint64(len(wraps)),
-			Size:  size,
-		}
-		i++
+	switch v := reflect.ValueOf(item); v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+		return v.IsNil()
 	}
-	return keys
+	return false
 }
 
-// On registers an event handler for an event type
-func (s *Store) On(event Event, notify NotifyFunc) {
-	switch event {
-	case Insert:
-		s.insertNotifiers = append(s.insertNotifiers, notify)
-	case Update:
-		s.updateNotifiers = append(s.updateNotifiers, notify)
-	case Remove:
-		s.removeNotifiers = append(s.removeNotifiers, notify)
-	case Expiry:
-		s.expiryNotifiers = append(s.expiryNotifiers, notify)
-	case Access:
-		s.accessNotifiers = append(s.accessNotifiers, notify)
-	default:
-		return
-	}
+func placeable(item interface{}) bool {
+	return item != nil && reflect.TypeOf(item).Comparable()
 }
 
-func (s *Store) findExpired() []*wrap {
-	s.RLock()
-	defer s.RUnlock()
-	now := time.Now()
+// hasUIDs returns whether the store is generating and tracking UIDs for its items
+func (s *Store) hasUIDs() bool {
+	return !s.noUID || s.persister != nil || s.uidFunc != nil
+}
 
-	var rm []*wrap
-	s.backing.Ascend(func(item btree.Item) bool {
-		if w, ok := item.(*wrap); ok {
-			// TODO - Possible lock contention here if this calls any store functions
-			w.RLock()
-			if s.IsExpired(w.item, now, w.stats) {
-				rm = append(rm, w)
-			}
-			w.RUnlock()
-		}
-		return true
-	})
+func (s *Store) log(level, msg string, kv ...interface{}) {
+	if s.logger != nil {
+		s.logger(level, msg, kv...)
+	}
+}
 
-	return rm
+// deliver calls the handlers for a happening
+func (s *Store) deliver(h *happening) {
+	if h.changes != nil {
+		s.emitBatch(h.changes)
+		return
+	}
+	if h.crossing != nil {
+		h.crossing.notify(h.crossing.count, h.crossing.rising)
+		return
+	}
+	s.emit(h.event, h.old, h.new, h.stats)
 }
 
 func (s *Store) emit(event Event, old, new interface{}, stats Stats) {
+	s.notifiers.RLock()
 	var handlers []NotifyFunc
 	switch event {
 	case Insert:
@@ -592,9 +2626,8 @@ func (s *Store) emit(event Event, old, new interface{}, stats Stats) {
 		handlers = s.expiryNotifiers
 	case Access:
 		handlers = s.accessNotifiers
-	default:
-		return
 	}
+	s.notifiers.RUnlock()
 
 	if len(handlers) > 0 {
 		for _, handler := range handlers {
@@ -603,58 +2636,151 @@ func (s *Store) emit(event Event, old, new interface{}, stats Stats) {
 	}
 }
 
+func (s *Store) emitBatch(changes []Change) {
+	s.notifiers.RLock()
+	handlers := s.batchNotifiers
+	s.notifiers.RUnlock()
+
+	for _, handler := range handlers {
+		handler(changes)
+	}
+}
+
 func (s *Store) add(item interface{}) (*wrap, *wrap, error) {
 	w := s.wrapIt(item)
 	ret := s.addWrap(w)
+	err := s.save(w)
 
-	var err error
-	if s.persister != nil {
-		id := string(w.UID())
-		if metaPersister, ok := s.persister.(persist.MetaPersister); ok {
-			var meta *persist.Meta
-			meta, err = metaPersister.MetaSave(id, item)
-			w.stats.Size = meta.Size
-		} else {
-			err = s.persister.Save(id, item)
-		}
+	return w, ret, err
+}
+
+// save persists the wrapped item, if the store is persistent
+func (s *Store) save(w *wrap) error {
+	if s.persister == nil {
+		return nil
 	}
 
-	return w, ret, err
+	id := string(w.UID())
+	if metaPersister, ok := s.persister.(persist.MetaPersister); ok {
+		meta, err := metaPersister.MetaSave(id, w.item)
+		if err != nil {
+			return err
+		}
+		w.stats.Size = meta.Size
+		return nil
+	}
+	return s.persister.Save(id, w.item)
 }
 
+// addWrap adds the wrap to the store, returning the equal wrap it replaced, or none if it only replaced other wraps in a
+// unique index, or nil if it replaced nothing
 func (s *Store) addWrap(w *wrap) *wrap {
+	ow, replaced := s.insertWrap(w)
+	if ow == nil && len(replaced) > 0 {
+		return none
+	}
+	return ow
+}
+
+// insertWrap adds the wrap to the store, returning the equal wrap it replaced (if any) and the wraps it replaced in
+// unique indexes
+func (s *Store) insertWrap(w *wrap) (ow *wrap, replaced []*wrap) {
 	s.used = true
-	w.UID()
+	if s.hasUIDs() {
+		w.UID()
+	}
 	found := s.backing.ReplaceOrInsert(w)
 
-	var ow *wrap
 	if found != nil {
 		ow = found.(*wrap)
 		w.stats = ow.stats
+		w.stats.w = w
+		delete(s.uids, ow.uid)
+		s.unplace(ow)
+		s.dropDeadlines(ow)
+	}
+	s.place(w)
+	if s.hasUIDs() {
+		s.uids[w.uid] = w
 	}
 
 	w.stats.written(time.Now())
+	if s.deadlines != nil {
+		s.deadlines.push(w)
+	}
 
-	var emitted bool
 	for _, index := range s.indexes {
-		key := w.values[index.n]
 		if ow != nil {
-			oldKey := ow.values[index.n]
-			s.rmFromIndex(index.id, oldKey, ow)
+			s.unindexWrap(index, ow)
 		}
-		emitted = s.addToIndex(index.id, key, w)
+		replaced = append(replaced, s.indexWrap(index, w)...)
 	}
 
+	s.assertIndexed(w, true)
+
 	if ow != nil {
-		return ow
+		s.assertIndexed(ow, false)
 	}
-	if emitted {
-		return none
+
+	s.capBuckets(w)
+	return
+}
+
+// capBuckets expires the oldest items from any capped index keys the wrap has taken over their limit
+// The wrap itself is never evicted, so that it can be persisted and reported as put.
+func (s *Store) capBuckets(w *wrap) {
+	for _, index := range s.indexes {
+		if index.capN <= 0 {
+			continue
+		}
+
+		for _, key := range w.values[index.n] {
+			wraps := s.index[index.id][key]
+			excess := len(wraps) - index.capN
+			if excess <= 0 {
+				continue
+			}
+
+			sorted := make([]*wrap, 0, len(wraps)-1)
+			for _, other := range wraps {
+				if other != w && !other.stats.Pinned {
+					sorted = append(sorted, other)
+				}
+			}
+			if excess > len(sorted) {
+				excess = len(sorted)
+			}
+			sort.SliceStable(sorted, func(i, j int) bool {
+				return index.older(sorted[i], sorted[j])
+			})
+			for _, evict := range sorted[:excess] {
+				if old, _ := s.rm(evict); old != nil {
+					stats := old.stats.copy()
+					stats.Reason = Evicted
+					s.notify(Expiry, old.item, nil, stats)
+				}
+			}
+		}
+	}
+}
+
+// indexWrap adds the wrap to each of its keys within the index
+func (s *Store) indexWrap(index *Index, w *wrap) (replaced []*wrap) {
+	for _, key := range w.values[index.n] {
+		replaced = append(replaced, s.addToIndex(index.id, key, w)...)
+	}
+	return
+}
+
+// unindexWrap removes the wrap from each of its keys within the index
+func (s *Store) unindexWrap(index *Index, w *wrap) {
+	for _, key := range w.values[index.n] {
+		s.rmFromIndex(index.id, key, w)
 	}
-	return nil
 }
 
-func (s *Store) addToIndex(indexID string, key string, wrapped *wrap) (emitted bool) {
+// addToIndex adds the wrap to the index under key, returning any wraps it replaced in a unique index
+func (s *Store) addToIndex(indexID string, key string, wrapped *wrap) (replaced []*wrap) {
 	index, ok := s.indexes[indexID]
 	if !ok {
 		return
@@ -662,7 +2788,7 @@ func (s *Store) addToIndex(indexID string, key string, wrapped *wrap) (emitted b
 
 	indexWraps, ok := s.index[indexID]
 	if !ok {
-		indexWraps = map[string][]*wrap{}
+		indexWraps = make(map[string][]*wrap, s.reserve)
 		s.index[indexID] = indexWraps
 	}
 
@@ -672,17 +2798,15 @@ func (s *Store) addToIndex(indexID string, key string, wrapped *wrap) (emitted b
 		for _, indexWrap := range indexWraps[key] {
 			rm, _ := s.rm(indexWrap)
 			if rm != nil {
-				s.happens <- &happening{
-					event: Update,
-					old:   rm.item,
-					new:   wrapped.item,
-					stats: wrapped.stats,
-				}
-				emitted = true
+				s.notify(Update, rm.item, wrapped.item, wrapped.stats.copy())
+				replaced = append(replaced, rm)
 			}
 		}
 		wraps = nil
 	}
+	if len(wraps) == 0 {
+		index.keys.ReplaceOrInsert(indexKey(key))
+	}
 	indexWraps[key] = append(wraps, wrapped)
 	return
 }
@@ -695,25 +2819,36 @@ func (s *Store) rm(item interface{}) (*wrap, error) {
 	} else {
 		search = &wrap{storer: s, item: item}
 	}
-	removed := s.backing.Delete(search)
+
+	w := s.detach(search)
+	if w == nil {
+		return nil, nil
+	}
 
 	var err error
-	if removed != nil {
-		w := removed.(*wrap)
-		if s.persister != nil {
-			err = s.persister.Remove(string(w.UID()))
-		}
+	if s.persister != nil {
+		err = s.persister.Remove(string(w.UID()))
+	}
+	return w, err
+}
 
-		for _, index := range s.indexes {
-			key := w.values[index.n]
-			s.rmFromIndex(index.id, key, w)
-		}
+// detach removes the wrap equal to search from the store and its indexes, leaving it in the persister
+func (s *Store) detach(search *wrap) *wrap {
+	removed := s.backing.Delete(search)
+	if removed == nil {
+		return nil
 	}
 
-	if removed != nil {
-		return removed.(*wrap), err
+	w := removed.(*wrap)
+	delete(s.uids, w.uid)
+	s.unplace(w)
+	s.dropDeadlines(w)
+	for _, index := range s.indexes {
+		s.unindexWrap(index, w)
 	}
-	return nil, err
+
+	s.assertIndexed(w, false)
+	return w
 }
 
 func (s *Store) rmFromIndex(indexID string, key string, wrapped *wrap) {
@@ -731,18 +2866,75 @@ func (s *Store) rmFromIndex(indexID string, key string, wrapped *wrap) {
 		if wrapped == wrap {
 			n := len(wraps)
 			if n == 1 && i == 0 {
-				indexWraps[key] = nil
+				delete(indexWraps, key)
+				if index, ok := s.indexes[indexID]; ok {
+					index.keys.Delete(indexKey(key))
+				}
 				return
 			}
-			wraps[i] = wraps[n-1]
+			if index, ok := s.indexes[indexID]; ok && index.ordered {
+				copy(wraps[i:], wraps[i+1:])
+			} else {
+				wraps[i] = wraps[n-1]
+			}
+			wraps[n-1] = nil
 			indexWraps[key] = wraps[:n-1]
 			return
 		}
 	}
 }
 
-func (s *Store) getIndexValue(item interface{}, index *Index) string {
-	return s.getFieldsValue(item, index.fields)
+func dedupe(keys []string) []string {
+	if len(keys) < 2 {
+		return keys
+	}
+
+	seen := make(map[string]bool, len(keys))
+	unique := keys[:0]
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+func (s *Store) sortKeys(keys []string) {
+	if s.reversed {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		return
+	}
+	sort.Strings(keys)
+}
+
+// getIndexValues returns the keys the item should be stored under in the index
+// Where a MultiFielder returns multiple values for the fields, every combination of the fields values is returned.
+func (s *Store) getIndexValues(item interface{}, index *Index) []string {
+	if index.compute != nil {
+		return []string{index.compute(item)}
+	}
+
+	multi, ok := s.fielder.(MultiFielder)
+	if !ok {
+		return []string{s.getFieldsValue(item, index.fields)}
+	}
+
+	keys := []string{""}
+	for i, field := range index.fields {
+		values := multi.GetFields(item, field)
+		combined := make([]string, 0, len(keys)*len(values))
+		for _, key := range keys {
+			for _, value := range values {
+				if i > 0 {
+					value = key + s.keySep + value
+				}
+				combined = append(combined, value)
+			}
+		}
+		keys = combined
+	}
+	return dedupe(keys)
 }
 
 func (s *Store) getFieldsValue(item interface{}, fields []string) string {
@@ -750,24 +2942,61 @@ func (s *Store) getFieldsValue(item interface{}, fields []string) string {
 	for i, field := range fields {
 		components[i] = s.GetField(item, field)
 	}
-	return strings.Join(components, "\000")
+	return s.joinKey(components)
 }
 
-func (s *Store) wrapIt(item interface{}) *wrap {
-	if wrapped, ok := item.(*wrap); ok {
-		return wrapped
+// joinKey joins the components of a compound key with the store's key separator
+func (s *Store) joinKey(components []string) string {
+	return strings.Join(components, s.keySep)
+}
+
+// splitKey splits a compound key into its components by the store's key separator
+func (s *Store) splitKey(key string) []string {
+	return strings.Split(key, s.keySep)
+}
+
+// indexKeys returns the keys the item is held under in the index
+func (s *Store) indexKeys(item interface{}, index *Index) []string {
+	keys := s.getIndexValues(item, index)
+	if index.numeric {
+		for i, key := range keys {
+			keys[i] = index.key(s.splitKey(key))
+		}
 	}
+	return keys
+}
 
-	values := make([]string, len(s.indexes))
+// indexValues returns the keys for the item in each of the store's indexes
+func (s *Store) indexValues(item interface{}) [][]string {
+	values := make([][]string, len(s.indexes))
 	for _, index := range s.indexes {
-		values[index.n] = s.getIndexValue(item, index)
+		if index.where != nil && !index.where(item) {
+			continue
+		}
+
+		values[index.n] = s.indexKeys(item, index)
+		for _, key := range values[index.n] {
+			if key == "" {
+				s.log("warn", "index key resolved empty", "index", index.fields, "item", item)
+			}
+		}
+	}
+	return values
+}
+
+func (s *Store) wrapIt(item interface{}) *wrap {
+	if wrapped, ok := item.(*wrap); ok {
+		return wrapped
 	}
 
 	now := time.Now()
 	w := &wrap{
 		storer: s,
 		item:   item,
-		values: values,
+		values: s.indexValues(item),
+	}
+	if s.uidFunc != nil {
+		w.uid = s.uidFunc(item)
 	}
 	w.stats = Stats{
 		w:        w,
@@ -777,21 +3006,32 @@ func (s *Store) wrapIt(item interface{}) *wrap {
 	return w
 }
 
+// access records a read of the wrapped item and emits an Access event for it, unless access tracking is disabled
+func (s *Store) access(w *wrap, now time.Time) {
+	if !s.trackAccess() {
+		return
+	}
+	w.stats.read(now)
+	s.notify(Access, w.item, w.item, w.stats.copy())
+}
+
+// trackAccess returns whether reads are counted in items' stats and emit Access events
+func (s *Store) trackAccess() bool {
+	return atomic.LoadInt32(&s.noAccess) == 0
+}
+
 func (s *Store) cbWrap(cb interface{}) btree.ItemIterator {
 	now := time.Now()
 	return func(i btree.Item) bool {
 		if w, ok := i.(*wrap); ok {
-			w.stats.read(now)
 			if iterator, ok := cb.(Iterator); ok {
-				s.happens <- &happening{
-					event: Access,
-					old:   w.item,
-					new:   w.item,
-					stats: w.stats,
-				}
+				s.access(w, now)
 				return iterator(w.item)
 			} else if info, ok := cb.(InfoIterator); ok {
-				return info(w.uid, w.item, w.stats)
+				if s.trackAccess() {
+					w.stats.read(now)
+				}
+				return info(w.uid, w.item, w.stats.copy())
 			}
 		}
 		return true
@@ -1,6 +1,8 @@
 package memdb
 
 import (
+	"context"
+	"io"
 	"time"
 
 	"github.com/nedscode/memdb/persist"
@@ -11,36 +13,113 @@ type Storer interface {
 	Indexer
 	SetIndexer(indexer Indexer)
 	SetComparator(comparator Comparator)
+	SetComparatorReindex(comparator Comparator)
 	SetExpirer(expirer Expirer)
 	SetFielder(fielder Fielder)
+	SetLogger(logger persist.LogFunc)
 
 	PrimaryKey(fields ...string) *Store
 	CreateIndex(fields ...string) *Store
+	CreateComputedIndex(name string, fn func(item interface{}) string) *Store
+	CreateIndexByJSON(name string, path string) *Store
 	Unique() *Store
+	Where(predicate func(item interface{}) bool) *Store
+	CapBucket(n int, by string) *Store
+	Numeric() *Store
+	Ordered() *Store
+	NoUID() *Store
+	SetUIDFunc(fn func(item interface{}) UID) *Store
+	StrictKeys(strict bool) *Store
+	StrictFields(strict bool) *Store
+	SetFloatFormat(format byte, precision int) *Store
+	SetFieldTag(tag string) *Store
+	SetDegree(degree int) *Store
+	SetKeySeparator(sep string) *Store
+	Reserve(n int) *Store
+	SetParallelNotify(parallel bool) *Store
 	Reversed(order ...bool) *Store
 
 	Persistent(persister persist.Persister) error
+	IsPersistent() bool
+	PersisterKind() string
+	MetaEnabled() bool
 
 	Get(search interface{}) interface{}
+	Contains(search interface{}) bool
+	Inspect(search interface{}) (*ItemInfo, bool)
+	Pin(search interface{}) bool
+	Unpin(search interface{}) bool
+	GetWithStats(search interface{}) (interface{}, Stats, bool)
+	GetByUID(uid UID) interface{}
+	GetByKey(keys ...string) interface{}
+	UID(search interface{}) (UID, bool)
 	Put(item interface{}) (interface{}, error)
+	PutWithResult(item interface{}) (*PutResult, error)
 	PutAll(items []interface{}) error
+	UpdateIf(pred func(item interface{}) bool, mutate func(item interface{})) (int, error)
+	Merge(other *Store, resolve func(existing, incoming interface{}) interface{}) error
 	Delete(search interface{}) (interface{}, error)
+	Replace(old, new interface{}) error
+	GetOrPut(item interface{}, create func() interface{}) (interface{}, bool, error)
+	GetAndDelete(search interface{}) (interface{}, bool)
+	DeleteIf(search interface{}, cond func(current interface{}) bool) (interface{}, bool, error)
 
 	InPrimaryKey() IndexSearcher
 	In(fields ...string) IndexSearcher
+	IndexByID(id string) IndexSearcher
+	IndexIDs() []string
 	Info(cb InfoIterator)
+	ModifiedSince(t time.Time) []interface{}
+	EachModifiedSince(t time.Time, cb InfoIterator)
 	Ascend(cb Iterator)
+	AscendContext(ctx context.Context, cb Iterator)
 	AscendStarting(at interface{}, cb Iterator)
+	AscendFrom(cursor Cursor, limit int) ([]interface{}, Cursor)
 	Descend(cb Iterator)
+	DescendContext(ctx context.Context, cb Iterator)
 	DescendStarting(at interface{}, cb Iterator)
+	IndexRange(fields []string, from, to []string, cb Iterator)
 
+	Reader() Reader
+	RLockFunc(cb func(ReadOnlyStorer))
+	LockFunc(cb func(LockedStorer))
+
+	Clear() error
+	Export(w io.Writer) error
+	Import(r io.Reader, factory persist.FactoryFunc) error
+	Close() error
+	Verify() []error
+	Repair() int
 	Expire() int
+	ExpireN(max int) int
 	ExpireInterval(interval time.Duration)
+	ExpireBatchSize(n int)
+	Due() int
 
 	Len() int
+	IsEmpty() bool
+	LenIn(fields ...string) int
+	First() interface{}
+	Last() interface{}
 	Indexes() [][]string
+	IndexInfo() []*IndexInfo
 	IndexStats(fields ...string) []*IndexStats
+	AllIndexStats() map[string][]*IndexStats
+	IndexCardinality(fields ...string) int
+	BucketSizes(fields ...string) map[string]int
+	IndexMemoryEstimate() map[string]uint64
+	StoreStats() *StoreStats
 	Keys(fields ...string) []string
+	KeysSorted(fields ...string) []string
+	EachKey(cb func(key string, count int) bool, fields ...string)
 
 	On(event Event, notify NotifyFunc)
+	OnBatch(notify BatchNotifyFunc)
+	ExpiredChan() <-chan interface{}
+	OnSize(high, low int, notify SizeFunc)
+	NotifyBacklog() int
+	OnConflict(index string, handler ConflictFunc)
+	SetOnAccess(hook func(item interface{}))
+	SetTrackAccess(track bool)
+	OnExpiring(hook ExpiringFunc)
 }
@@ -1,43 +1,158 @@
 package memdb
 
 import (
+	"crypto/rand"
+	"fmt"
 	"math"
-	"math/rand"
+	"strings"
+	"sync"
 	"time"
 )
 
 // UID is a unique ID generated from a timestamp and random entropy
 type UID string
 
+const (
+	// safeChars are the characters UIDs are made of, chosen to avoid ambiguous characters
+	safeChars = "23456789ABCDEFGHJKLMNPQRSTWXYZabcdefghijkmnopqrstuvwxyz"
+
+	// uidLen is the length of a UID, uidTimeLen is the number of leading characters which encode its time
+	uidLen     = 12
+	uidTimeLen = 7
+
+	// uidWeek is the number of nanoseconds in a week, the first two characters of a UID encode the week and the
+	// following characters the offset within it
+	uidWeek = float64(86400000000000 * 7)
+)
+
+// uidState holds the last UID generated, so UIDs generated within the same time window are kept unique and ordered
+var uidState struct {
+	sync.Mutex
+	last [uidLen]byte
+}
+
 // NewUID creates a new UID that you can use for a wrapped Indexer or anything else
+// UIDs generated within the same time window (around a millisecond) share their leading characters, and their
+// trailing characters follow on from the previous UID's, so UIDs from a single process never collide.
 func NewUID() UID {
-	safeChars := "23456789ABCDEFGHJKLMNPQRSTWXYZabcdefghijkmnopqrstuvwxyz"
+	uidState.Lock()
+	defer uidState.Unlock()
+
+	for {
+		id := uidTime(time.Now())
+		if string(id[:uidTimeLen]) == string(uidState.last[:uidTimeLen]) {
+			if !uidIncrement(uidState.last[uidTimeLen:]) {
+				// Every UID for this time window has been used, wait for the next
+				time.Sleep(time.Microsecond)
+				continue
+			}
+			copy(id[uidTimeLen:], uidState.last[uidTimeLen:])
+		} else {
+			uidRandom(id[uidTimeLen:])
+		}
 
+		uidState.last = id
+		return UID(id[:])
+	}
+}
+
+// uidTime returns the characters of a UID for the time t, with the trailing entropy characters unset
+func uidTime(t time.Time) [uidLen]byte {
 	var (
-		now   = float64(time.Now().UnixNano())
+		now   = float64(t.UnixNano())
 		n     = len(safeChars)
 		scale = float64(n)
-		week  = float64(86400000000000 * 7)
-		weeks = math.Floor(now / week)
-		ofs   = now - weeks*week
-		id    = make([]byte, 12)
+		weeks = math.Floor(now / uidWeek)
+		ofs   = now - weeks*uidWeek
+		id    [uidLen]byte
 	)
 
 	id[0] = safeChars[int64(weeks/scale)%int64(scale)]
 	id[1] = safeChars[int64(weeks)%int64(scale)]
 
-	for i := 2; i < 7; i++ {
-		r := math.Floor(ofs / week * scale)
-		ofs -= r * week / scale
+	for i := 2; i < uidTimeLen; i++ {
+		r := math.Floor(ofs / uidWeek * scale)
+		ofs -= r * uidWeek / scale
 		scale *= float64(n)
 		id[i] = safeChars[int64(r)]
 	}
+	return id
+}
+
+// uidRandom fills chars with random safe characters from crypto/rand
+// The first character is drawn from the lower half of safeChars, leaving room for the characters to be incremented.
+func uidRandom(chars []byte) {
+	n := len(safeChars)
+	limit := byte(256 - 256%n)
+
+	buf := make([]byte, 2*len(chars))
+	for i := 0; i < len(chars); {
+		if _, err := rand.Read(buf); err != nil {
+			panic(fmt.Sprintf("memdb: unable to read random bytes for UID: %s", err))
+		}
+
+		for _, b := range buf {
+			if b >= limit || i == len(chars) {
+				continue
+			}
 
-	for i := 7; i < 12; i++ {
-		id[i] = safeChars[rand.Int31n(int32(n))]
+			c := int(b) % n
+			if i == 0 {
+				c /= 2
+			}
+			chars[i] = safeChars[c]
+			i++
+		}
 	}
+}
+
+// uidIncrement increments chars as a number in base len(safeChars), returning false if it overflows
+func uidIncrement(chars []byte) bool {
+	for i := len(chars) - 1; i >= 0; i-- {
+		c := strings.IndexByte(safeChars, chars[i]) + 1
+		if c < len(safeChars) {
+			chars[i] = safeChars[c]
+			return true
+		}
+		chars[i] = safeChars[0]
+	}
+	return false
+}
+
+// DecodeUID returns the time embedded in the UID s, which is accurate to around a millisecond
+// An error is returned if s is not a well formed UID.
+func DecodeUID(s string) (time.Time, error) {
+	if len(s) != uidLen {
+		return time.Time{}, fmt.Errorf("memdb: malformed UID %q, expected %d characters", s, uidLen)
+	}
+
+	var digits [uidTimeLen]float64
+	for i := 0; i < uidLen; i++ {
+		c := strings.IndexByte(safeChars, s[i])
+		if c < 0 {
+			return time.Time{}, fmt.Errorf("memdb: malformed UID %q, invalid character %q", s, s[i])
+		}
+		if i < uidTimeLen {
+			digits[i] = float64(c)
+		}
+	}
+
+	n := float64(len(safeChars))
+	ns := (digits[0]*n + digits[1]) * uidWeek
+
+	scale := n
+	for i := 2; i < uidTimeLen; i++ {
+		ns += digits[i] * uidWeek / scale
+		scale *= n
+	}
+
+	return time.Unix(0, int64(ns)), nil
+}
 
-	return UID(id)
+// Time returns the time embedded in the UID, or the zero time if the UID is malformed
+func (u UID) Time() time.Time {
+	t, _ := DecodeUID(string(u))
+	return t
 }
 
 func (u UID) String() string {
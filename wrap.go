@@ -16,7 +16,18 @@ type Stats struct {
 	Reads    uint64
 	Writes   uint64
 	Size     uint64
-	w        *wrap
+
+	// Pinned is set for items which have been pinned via Pin, pinned items are exempt from expiry
+	Pinned bool
+
+	// Reason is why the item was expired, it is only set for the stats of Expiry events
+	Reason ExpiryReason
+
+	// Seq is the store's sequence number of the event these stats were delivered with, it is only set for stats
+	// received by a NotifyFunc and can be used to reconstruct the order in which events occurred.
+	Seq uint64
+
+	w *wrap
 }
 
 func (s *Stats) read(t time.Time) {
@@ -35,6 +46,21 @@ func (s *Stats) written(t time.Time) {
 	s.Writes++
 }
 
+// refresh updates the modified time without counting a write, so the item is treated as freshly modified by expirers
+func (s *Stats) refresh(t time.Time) {
+	s.w.Lock()
+	defer s.w.Unlock()
+
+	s.Modified = t
+}
+
+func (s *Stats) pin(pinned bool) {
+	s.w.Lock()
+	defer s.w.Unlock()
+
+	s.Pinned = pinned
+}
+
 func (s *Stats) set(from Stats) {
 	s.w.Lock()
 	defer s.w.Unlock()
@@ -47,9 +73,19 @@ func (s *Stats) set(from Stats) {
 	s.Size = from.Size
 }
 
+// copy returns a snapshot of the stats which is detached from the stored item
+func (s *Stats) copy() Stats {
+	s.w.RLock()
+	defer s.w.RUnlock()
+
+	c := *s
+	c.w = nil
+	return c
+}
+
 // IsZero returns whether the statistic has an item or not
 func (s *Stats) IsZero() bool {
-	return s.w == nil
+	return s.w == nil && s.Created.IsZero()
 }
 
 type wrap struct {
@@ -58,8 +94,15 @@ type wrap struct {
 	storer Storer
 	uid    UID
 	item   interface{}
-	values []string
+	values [][]string
 	stats  Stats
+	due    int       // position in the store's deadline heap plus one, or zero if not queued
+	held   time.Time // vetoed by an OnExpiring hook, so not expired before this time
+}
+
+// expirable returns whether the wrap may be expired at now, must be called with the wrap's lock held
+func (w *wrap) expirable(now time.Time) bool {
+	return !w.stats.Pinned && !now.Before(w.held)
 }
 
 // UID generates a unique UID for a wrap instance